@@ -2,50 +2,139 @@ package quic
 
 import "time"
 
-const initialCwnd = 2 * maxPacketSize
+// initialCwnd is the initial congestion window, in packets.
+const initialCwnd = 2
 
+// A CongestionController decides how many bytes a connection may have in
+// flight, see Config.NewCongestionController. The sizes it is told about are
+// those of the packets, padding included: padding takes up the path like any
+// other bytes. Sent tells apart how much of a packet is padding. Its methods are called with the
+// connection's mutex held, so they need no synchronization of their own, and
+// must not block.
+type CongestionController interface {
+	// CwndLimited reports whether the congestion window is too small to
+	// send another packet with inFlightBytes in flight.
+	CwndLimited(inFlightBytes int, now time.Time) bool
+
+	// Cwnd returns the congestion window, in bytes. Unless the controller
+	// is a PacingCongestionController, the connection paces packets to
+	// send about a window per RTT.
+	Cwnd() int
+
+	// Sent is called when an ack-eliciting packet of size bytes was sent,
+	// padding of which were padding, see Config.PaddingPolicy. It is
+	// followed by Validate.
+	Sent(size, padding int, now time.Time)
+
+	// Validate is called whenever inFlightBytes grows. It lets the
+	// controller shrink a congestion window the connection has not been
+	// using, see RFC 7661.
+	Validate(inFlightBytes int, now time.Time)
+
+	// Ack is called when a packet of size bytes, sent at sent, was
+	// acknowledged.
+	Ack(size int, sent, now time.Time)
+
+	// Loss is called when a packet of size bytes, sent at sent, was
+	// declared lost. A single congestion event usually makes several
+	// packets lost: packets sent before the controller reacted to the first
+	// loss should not make it react again.
+	Loss(size int, sent, now time.Time)
+
+	// Congestion is called when the peer reported that a router on the
+	// path marked packets Congestion Experienced instead of dropping them,
+	// see RFC 9002, Section 7.1. Packets up to the one sent at sent were
+	// acknowledged. Like with Loss, packets sent before the controller
+	// reacted should not make it react again.
+	Congestion(sent, now time.Time)
+}
+
+// A PacingCongestionController is a CongestionController that also tells the
+// rate to pace packets at, instead of the connection deriving it from the
+// congestion window.
+type PacingCongestionController interface {
+	CongestionController
+
+	// PacingRate returns the rate to send packets at, in bytes per second.
+	PacingRate() float64
+}
+
+// RTTStats are the round-trip time estimates of a connection's current path,
+// see Config.NewCongestionController.
+type RTTStats interface {
+	// MinRTT returns the minimum RTT seen over the last minute, or 0 if no
+	// RTT was sampled yet.
+	MinRTT() time.Duration
+
+	// SmoothedRTT returns the exponentially weighted moving average of the
+	// RTT samples, or an initial estimate if no RTT was sampled yet.
+	SmoothedRTT() time.Duration
+
+	// PTO returns the probe timeout, see RFC 9002, Section 6.2.
+	PTO() time.Duration
+}
+
+// The default congestion controller operates under the assumption that the
+// transmission rate is always application-bound, thus it is always in slow
+// start. Whenever congestion occurs, the congestion window is reset.
 type congestionController struct {
+	maxPacketSize int
+	rtt           RTTStats
+
 	cwnd      int
 	congested time.Time
 	validated time.Time
 }
 
-func newCongestionController(now time.Time) *congestionController {
+func newCongestionController(maxPacketSize int, rtt RTTStats, now time.Time) CongestionController {
 	return &congestionController{
-		cwnd:      initialCwnd,
+		maxPacketSize: maxPacketSize,
+		rtt:           rtt,
+
+		cwnd:      initialCwnd * maxPacketSize,
 		congested: now, // avoid having packets sent with the old congestion controller contribute
 		validated: now,
 	}
 }
 
+func (c *congestionController) Sent(size, padding int, now time.Time) {}
+
 func (c *congestionController) Ack(size int, sent, now time.Time) {
 	if !sent.Before(c.congested) {
 		c.cwnd += size
 	}
 }
 
-func (c *congestionController) Loss(sent, now time.Time) {
+func (c *congestionController) Loss(size int, sent, now time.Time) {
+	c.Congestion(sent, now)
+}
+
+func (c *congestionController) Congestion(sent, now time.Time) {
 	if !sent.Before(c.congested) {
-		c.cwnd = initialCwnd
+		c.cwnd = initialCwnd * c.maxPacketSize
 		c.congested = now
 	}
 }
 
-func (c *congestionController) validatedCwnd(inFlightBytes int, pto time.Duration, now time.Time) int {
-	cwnd := c.cwnd
-	t := c.validated.Add(pto)
-	for inFlightBytes+maxPacketSize < cwnd/2 && t.Before(now) {
-		cwnd /= 2
-		t = t.Add(pto)
-	}
-	return max(cwnd, initialCwnd)
-}
+func (c *congestionController) Cwnd() int { return c.cwnd }
 
-func (c *congestionController) CwndLimited(inFlightBytes int, pto time.Duration, now time.Time) bool {
-	return inFlightBytes+maxPacketSize > c.validatedCwnd(inFlightBytes, pto, now)
+func (c *congestionController) CwndLimited(inFlightBytes int, now time.Time) bool {
+	return inFlightBytes+c.maxPacketSize > validatedCwnd(c.cwnd, inFlightBytes, c.maxPacketSize, c.validated, c.rtt.PTO(), now)
 }
 
-func (c *congestionController) Validate(inFlightBytes int, pto time.Duration, now time.Time) {
-	c.cwnd = c.validatedCwnd(inFlightBytes, pto, now)
+func (c *congestionController) Validate(inFlightBytes int, now time.Time) {
+	c.cwnd = validatedCwnd(c.cwnd, inFlightBytes, c.maxPacketSize, c.validated, c.rtt.PTO(), now)
 	c.validated = now
 }
+
+// validatedCwnd returns cwnd halved for every PTO since validated that the
+// connection used less than half of it, but not below the initial congestion
+// window.
+func validatedCwnd(cwnd, inFlightBytes, maxPacketSize int, validated time.Time, pto time.Duration, now time.Time) int {
+	t := validated.Add(pto)
+	for inFlightBytes+maxPacketSize < cwnd/2 && t.Before(now) {
+		cwnd /= 2
+		t = t.Add(pto)
+	}
+	return max(cwnd, initialCwnd*maxPacketSize)
+}
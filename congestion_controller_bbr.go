@@ -0,0 +1,343 @@
+package quic
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Constants of BBR, see draft-cardwell-iccrg-bbr-congestion-control-00.
+const (
+	// bbrHighGain is the smallest gain that doubles the sending rate every
+	// round in startup.
+	bbrHighGain = 2.885 // 2/ln(2)
+
+	// Startup ends once the bandwidth estimate has grown by less than
+	// bbrFullBWThresh for bbrFullBWRounds rounds.
+	bbrFullBWThresh = 1.25
+	bbrFullBWRounds = 3
+
+	// The bandwidth estimate is the max of the samples of the last
+	// bbrBWWindow rounds.
+	bbrBWWindow = 10
+
+	bbrMinRTTWindow     = 10 * time.Second
+	bbrProbeRTTDuration = 200 * time.Millisecond
+	bbrMinCwnd          = 4 // packets
+)
+
+// The pacing gains of the phases of probe-bandwidth: the first phase probes
+// for more bandwidth, the second drains the queue the probing created.
+var bbrPacingGainCycle = [...]float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+type bbrState int
+
+const (
+	bbrStartup bbrState = iota
+	bbrDrain
+	bbrProbeBW
+	bbrProbeRTT
+)
+
+// bbrSend remembers how much was delivered when the packets sent at sent were
+// sent, so that the acks of the packets sample the delivery rate.
+type bbrSend struct {
+	sent          time.Time
+	delivered     int64
+	deliveredTime time.Time
+}
+
+// bbrMaxSends bounds the number of remembered sends.
+const bbrMaxSends = 1 << 14
+
+type bbrCongestionController struct {
+	maxPacketSize int
+	rtt           RTTStats
+
+	state      bbrState
+	pacingGain float64
+	cwndGain   float64
+
+	cwnd      int
+	priorCwnd int // to restore after probe-RTT
+	inFlight  int
+
+	// Delivery rate sampling
+	delivered     int64 // bytes
+	deliveredTime time.Time
+	sends         []bbrSend // by time
+
+	// Rounds: a round ends when a packet sent after it started is acked.
+	round              int64
+	nextRoundDelivered int64
+
+	// Max filter of the delivery rate, by round
+	bw [bbrBWWindow]float64 // bytes per second
+
+	// Startup
+	filled      bool // the pipe was filled in startup
+	fullBW      float64
+	fullBWCount int
+
+	// Min filter of the RTT
+	minRTT      time.Duration
+	minRTTStamp time.Time
+
+	// Probe-bandwidth
+	cycleIndex int
+	cycleStamp time.Time
+
+	// Probe-RTT
+	probeRTTDone      time.Time // zero until inFlight is low enough
+	probeRTTDoneRound int64
+}
+
+// NewBBRCongestionController returns a congestion controller modeled after BBR.
+// Instead of reacting to losses, BBR estimates the bottleneck bandwidth and
+// the min RTT of the path, and paces packets at the estimated bandwidth, with
+// a window of about twice the bandwidth-delay product. This keeps the queues
+// at the bottleneck short, even if the bottleneck has a deep buffer.
+//
+// BBR cycles through the following phases: startup, which grows the sending
+// rate exponentially until the bandwidth estimate stops growing; drain, which
+// drains the queue startup created; probe-bandwidth, which sends at the
+// estimated bandwidth most of the time, but periodically probes for more; and
+// probe-RTT, which briefly shrinks the window every 10 seconds the min RTT
+// wasn't seen, to let the queue drain and the min RTT be measured again.
+func NewBBRCongestionController(maxPacketSize int, rtt RTTStats, now time.Time) CongestionController {
+	c := &bbrCongestionController{
+		maxPacketSize: maxPacketSize,
+		rtt:           rtt,
+
+		cwnd:          initialCwnd * maxPacketSize,
+		deliveredTime: now,
+		minRTTStamp:   now,
+	}
+	c.enterStartup()
+	return c
+}
+
+func (c *bbrCongestionController) enterStartup() {
+	c.state = bbrStartup
+	c.pacingGain = bbrHighGain
+	c.cwndGain = bbrHighGain
+}
+
+func (c *bbrCongestionController) enterDrain() {
+	c.state = bbrDrain
+	c.pacingGain = 1 / bbrHighGain
+	c.cwndGain = bbrHighGain
+}
+
+func (c *bbrCongestionController) enterProbeBW(now time.Time) {
+	c.state = bbrProbeBW
+	c.cwndGain = 2
+	c.cycleIndex = 2 // start cruising, the queue was just drained
+	c.cycleStamp = now
+	c.pacingGain = bbrPacingGainCycle[c.cycleIndex]
+}
+
+func (c *bbrCongestionController) enterProbeRTT() {
+	c.state = bbrProbeRTT
+	c.pacingGain = 1
+	c.cwndGain = 1
+	c.priorCwnd = c.cwnd
+	c.probeRTTDone = time.Time{}
+}
+
+// maxBW returns the bandwidth estimate, or zero if there's none yet.
+func (c *bbrCongestionController) maxBW() float64 {
+	bw := 0.0
+	for _, sample := range c.bw {
+		bw = math.Max(bw, sample)
+	}
+	return bw
+}
+
+// bdp returns the estimated bandwidth-delay product times gain, or zero if
+// there's no estimate yet.
+func (c *bbrCongestionController) bdp(gain float64) int {
+	return int(gain * c.maxBW() * c.minRTT.Seconds())
+}
+
+// PacingRate implements PacingCongestionController.
+func (c *bbrCongestionController) PacingRate() float64 {
+	if bw := c.maxBW(); bw > 0 {
+		return c.pacingGain * bw
+	}
+	return c.pacingGain * float64(c.cwnd) / c.rtt.SmoothedRTT().Seconds()
+}
+
+func (c *bbrCongestionController) Sent(size, padding int, now time.Time) {
+	c.inFlight += size
+
+	if len(c.sends) > 0 && c.sends[len(c.sends)-1].sent.Equal(now) {
+		return // several packets sent at once
+	}
+	// Forgetting sends only reslices c.sends, append reallocates it once
+	// in a while, so a send costs amortized constant time.
+	c.forgetSends(now)
+	if len(c.sends) == bbrMaxSends {
+		c.sends = c.sends[1:]
+	}
+	c.sends = append(c.sends, bbrSend{
+		sent:          now,
+		delivered:     c.delivered,
+		deliveredTime: c.deliveredTime,
+	})
+}
+
+func (c *bbrCongestionController) Validate(inFlightBytes int, now time.Time) {}
+
+// lookupSend returns the send of the packets sent at sent.
+func (c *bbrCongestionController) lookupSend(sent time.Time) (bbrSend, bool) {
+	i := sort.Search(len(c.sends), func(i int) bool { return !c.sends[i].sent.Before(sent) })
+	if i == len(c.sends) || !c.sends[i].sent.Equal(sent) {
+		return bbrSend{}, false
+	}
+	return c.sends[i], true
+}
+
+// forgetSends forgets the sends that are too old to be acked anymore: the
+// connection declares packets lost within a few PTOs.
+func (c *bbrCongestionController) forgetSends(now time.Time) {
+	horizon := now.Add(-8 * c.rtt.PTO())
+	i := sort.Search(len(c.sends), func(i int) bool { return !c.sends[i].sent.Before(horizon) })
+	c.sends = c.sends[i:]
+}
+
+func (c *bbrCongestionController) Ack(size int, sent, now time.Time) {
+	c.inFlight = max(c.inFlight-size, 0)
+	c.delivered += int64(size)
+	c.deliveredTime = now
+
+	s, ok := c.lookupSend(sent)
+	c.forgetSends(now)
+	if !ok {
+		return
+	}
+
+	// Count rounds
+	roundStart := false
+	if s.delivered >= c.nextRoundDelivered {
+		c.nextRoundDelivered = c.delivered
+		c.round++
+		c.bw[c.round%bbrBWWindow] = 0
+		roundStart = true
+	}
+
+	// Sample the delivery rate. Samples taken while the connection had
+	// less to send than it could are too low, but the max filter mostly
+	// ignores them.
+	if interval := now.Sub(s.deliveredTime); interval > 0 {
+		bw := float64(c.delivered-s.delivered) / interval.Seconds()
+		c.bw[c.round%bbrBWWindow] = math.Max(c.bw[c.round%bbrBWWindow], bw)
+	}
+
+	// Sample the RTT
+	rtt := now.Sub(sent)
+	minRTTExpired := now.Sub(c.minRTTStamp) > bbrMinRTTWindow
+	if c.minRTT == 0 || rtt <= c.minRTT || minRTTExpired {
+		c.minRTT = rtt
+		c.minRTTStamp = now
+	}
+
+	c.updateState(roundStart, minRTTExpired, now)
+	c.updateCwnd(size)
+}
+
+func (c *bbrCongestionController) updateState(roundStart, minRTTExpired bool, now time.Time) {
+	if c.state == bbrStartup && roundStart {
+		if bw := c.maxBW(); bw >= c.fullBW*bbrFullBWThresh {
+			c.fullBW = bw
+			c.fullBWCount = 0
+		} else if c.fullBWCount++; c.fullBWCount >= bbrFullBWRounds {
+			c.filled = true
+			c.enterDrain()
+		}
+	}
+
+	if c.state == bbrDrain && c.inFlight <= c.bdp(1) {
+		c.enterProbeBW(now)
+	}
+
+	if c.state == bbrProbeBW {
+		c.advanceCycle(now)
+	}
+
+	if minRTTExpired && c.state != bbrProbeRTT {
+		c.enterProbeRTT()
+	}
+	if c.state == bbrProbeRTT {
+		c.probeRTT(roundStart, now)
+	}
+}
+
+// advanceCycle advances the probe-bandwidth phase, which lasts about a min RTT.
+func (c *bbrCongestionController) advanceCycle(now time.Time) {
+	elapsed := now.Sub(c.cycleStamp) > c.minRTT
+	switch c.pacingGain {
+	case 1.25:
+		// Probe until the queue holds the extra data.
+		elapsed = elapsed && c.inFlight >= c.bdp(c.pacingGain)
+	case 0.75:
+		// Stop draining as soon as the queue is empty.
+		elapsed = elapsed || c.inFlight <= c.bdp(1)
+	}
+	if elapsed {
+		c.cycleIndex = (c.cycleIndex + 1) % len(bbrPacingGainCycle)
+		c.cycleStamp = now
+		c.pacingGain = bbrPacingGainCycle[c.cycleIndex]
+	}
+}
+
+func (c *bbrCongestionController) probeRTT(roundStart bool, now time.Time) {
+	if c.probeRTTDone.IsZero() {
+		if c.inFlight <= bbrMinCwnd*c.maxPacketSize {
+			c.probeRTTDone = now.Add(bbrProbeRTTDuration)
+			c.probeRTTDoneRound = c.round + 1
+		}
+		return
+	}
+	if now.After(c.probeRTTDone) && c.round >= c.probeRTTDoneRound {
+		c.minRTTStamp = now
+		c.cwnd = max(c.cwnd, c.priorCwnd)
+		if c.filled {
+			c.enterProbeBW(now)
+		} else {
+			c.enterStartup()
+		}
+	}
+}
+
+func (c *bbrCongestionController) updateCwnd(acked int) {
+	if c.state == bbrProbeRTT {
+		c.cwnd = min(c.cwnd, bbrMinCwnd*c.maxPacketSize)
+		return
+	}
+
+	target := c.bdp(c.cwndGain) + 3*c.maxPacketSize
+	switch {
+	case c.maxBW() == 0:
+		c.cwnd += acked
+	case c.filled:
+		c.cwnd = min(c.cwnd+acked, target)
+	case c.cwnd < target:
+		c.cwnd += acked
+	}
+	c.cwnd = max(c.cwnd, bbrMinCwnd*c.maxPacketSize)
+}
+
+// Loss leaves the model be: BBR doesn't take losses as a sign of congestion.
+func (c *bbrCongestionController) Loss(size int, sent, now time.Time) {
+	c.inFlight = max(c.inFlight-size, 0)
+}
+
+// Congestion leaves the model be too, like Loss.
+func (c *bbrCongestionController) Congestion(sent, now time.Time) {}
+
+func (c *bbrCongestionController) Cwnd() int { return c.cwnd }
+
+func (c *bbrCongestionController) CwndLimited(inFlightBytes int, now time.Time) bool {
+	return inFlightBytes+c.maxPacketSize > c.cwnd
+}
@@ -0,0 +1,206 @@
+package quic
+
+import (
+	"testing"
+	"time"
+)
+
+// bottleneck is a simulated path with a single bottleneck link, whose queue
+// can hold buffer bytes, and whose RTT is rtt when the queue is empty.
+type bottleneck struct {
+	rate   float64 // bytes per second
+	rtt    time.Duration
+	buffer int
+
+	// If not zero, the path changes to one with RTT rerouteRTT reroute
+	// into the simulation.
+	reroute    time.Duration
+	rerouteRTT time.Duration
+}
+
+type simPacket struct {
+	size   int
+	sent   time.Time
+	at     time.Time // when the packet is acked, or declared lost
+	lost   bool
+	queued time.Duration // time the packet spent in the queue
+}
+
+type simResult struct {
+	states        []bbrState    // the BBR states visited, in order
+	maxQueueDelay time.Duration // after startup
+	delivered     int           // bytes, after startup
+}
+
+// simulate has a connection with congestion controller cc send as much as cc
+// allows over path for d, and reports how it went. Queueing delays and
+// deliveries are only counted after warmup.
+func simulate(newCongestionController func(maxPacketSize int, rtt RTTStats, now time.Time) CongestionController, path bottleneck, d, warmup time.Duration) simResult {
+	const maxPacketSize = 1200
+	const step = 100 * time.Microsecond
+
+	start := time.Date(2000, 1, 1, 1, 1, 1, 0, time.UTC)
+	rtt := newRTTFilter(0)
+	cc := newCongestionController(maxPacketSize, rtt, start)
+	var pacer pacer
+
+	var result simResult
+	inFlight := 0
+	var linkFree time.Time          // when the link is done transmitting the queued packets
+	var inFlightPackets []simPacket // by at: the link is FIFO
+
+	for now := start; now.Before(start.Add(d)); now = now.Add(step) {
+		for len(inFlightPackets) > 0 && !now.Before(inFlightPackets[0].at) {
+			p := inFlightPackets[0]
+			inFlightPackets = inFlightPackets[1:]
+			inFlight -= p.size
+			if p.lost {
+				cc.Loss(p.size, p.sent, now)
+				continue
+			}
+			rtt.Update(now.Sub(p.sent), 0, now)
+			cc.Ack(p.size, p.sent, now)
+			if now.Sub(start) >= warmup {
+				result.maxQueueDelay = max(result.maxQueueDelay, p.queued)
+				result.delivered += p.size
+			}
+		}
+
+		for !cc.CwndLimited(inFlight, now) && pacer.Ready(maxPacketSize, pacingRate(cc, rtt), now) {
+			p := simPacket{size: maxPacketSize, sent: now}
+			pathRTT := path.rtt
+			if path.reroute != 0 && now.Sub(start) >= path.reroute {
+				pathRTT = path.rerouteRTT
+			}
+			service := time.Duration(float64(p.size) / path.rate * float64(time.Second))
+			if linkFree.Before(now) {
+				linkFree = now
+			}
+			if queued := float64(linkFree.Sub(now)) / float64(time.Second) * path.rate; int(queued) > path.buffer {
+				// Tail drop, noticed when the next packet is
+				// acked.
+				p.lost = true
+				p.at = linkFree.Add(service + pathRTT)
+			} else {
+				p.queued = linkFree.Sub(now)
+				linkFree = linkFree.Add(service)
+				p.at = linkFree.Add(pathRTT)
+			}
+			inFlightPackets = append(inFlightPackets, p)
+
+			inFlight += p.size
+			cc.Sent(p.size, 0, now)
+			cc.Validate(inFlight, now)
+			pacer.Sent(p.size)
+		}
+
+		if bbr, ok := cc.(*bbrCongestionController); ok {
+			if len(result.states) == 0 || result.states[len(result.states)-1] != bbr.state {
+				result.states = append(result.states, bbr.state)
+			}
+		}
+	}
+	return result
+}
+
+// An LTE-like uplink: 10 Mbit/s with a 40ms RTT, and a queue that can hold
+// more than a second of data.
+var bufferbloatedPath = bottleneck{
+	rate:   10e6 / 8,
+	rtt:    40 * time.Millisecond,
+	buffer: 2 << 20,
+}
+
+func TestBBRQueueingDelay(t *testing.T) {
+	const d, warmup = 30 * time.Second, 5 * time.Second
+
+	result := simulate(NewBBRCongestionController, bufferbloatedPath, d, warmup)
+
+	// BBR keeps about a bandwidth-delay product of data in the queue at
+	// most, and only when probing for bandwidth.
+	if result.maxQueueDelay > bufferbloatedPath.rtt {
+		t.Errorf("max queueing delay = %v, want at most %v", result.maxQueueDelay, bufferbloatedPath.rtt)
+	}
+	if throughput := float64(result.delivered) / (d - warmup).Seconds(); throughput < 0.9*bufferbloatedPath.rate {
+		t.Errorf("throughput = %.0f B/s, want at least 90%% of %.0f B/s", throughput, bufferbloatedPath.rate)
+	}
+
+	checkBBRStates(t, result.states, []bbrState{bbrStartup, bbrDrain, bbrProbeBW})
+}
+
+// TestBBRProbeRTT checks that BBR notices the min RTT grow, after the path got
+// longer, by probing the RTT.
+func TestBBRProbeRTT(t *testing.T) {
+	path := bufferbloatedPath
+	path.reroute = 5 * time.Second
+	path.rerouteRTT = 2 * path.rtt
+
+	result := simulate(NewBBRCongestionController, path, 30*time.Second, 20*time.Second)
+
+	// The min RTT of the old path expires 10 seconds after it was last
+	// seen.
+	checkBBRStates(t, result.states, []bbrState{bbrStartup, bbrDrain, bbrProbeBW, bbrProbeRTT, bbrProbeBW})
+	if result.maxQueueDelay > path.rerouteRTT {
+		t.Errorf("max queueing delay = %v, want at most %v", result.maxQueueDelay, path.rerouteRTT)
+	}
+}
+
+// checkBBRStates checks that BBR visited the states want, and then only
+// alternated between probe-bandwidth and probe-RTT. The pacer's bursts keep
+// packets from finding the queue empty every gain cycle, so BBR may probe the
+// RTT every 10 seconds.
+func checkBBRStates(t *testing.T, states, want []bbrState) {
+	t.Helper()
+	if len(states) < len(want) {
+		t.Fatalf("states = %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("states = %v, want %v", states, want)
+		}
+	}
+	for i := len(want); i < len(states); i++ {
+		if (states[i] != bbrProbeBW && states[i] != bbrProbeRTT) || states[i] == states[i-1] {
+			t.Fatalf("states = %v, want %v followed by probe-RTT and probe-bandwidth", states, want)
+		}
+	}
+}
+
+// TestCUBICQueueingDelay shows what TestBBRQueueingDelay guards against: a
+// loss-based congestion controller fills the queue until packets are dropped.
+func TestCUBICQueueingDelay(t *testing.T) {
+	result := simulate(NewCUBICCongestionController, bufferbloatedPath, 30*time.Second, 5*time.Second)
+	if result.maxQueueDelay < time.Second {
+		t.Errorf("max queueing delay = %v, want more than a second", result.maxQueueDelay)
+	}
+}
+
+// TestBBRSends checks that BBR remembers at most bbrMaxSends sends, and forgets
+// the oldest ones first.
+func TestBBRSends(t *testing.T) {
+	now := time.Date(2000, 1, 1, 1, 1, 1, 0, time.UTC)
+	c := NewBBRCongestionController(1200, testRTTStats, now).(*bbrCongestionController)
+
+	start := now
+	for i := 0; i < 3*bbrMaxSends; i++ {
+		now = now.Add(time.Microsecond) // all within the horizon of forgetSends
+		c.Sent(1200, 0, now)
+	}
+	if len(c.sends) != bbrMaxSends {
+		t.Fatalf("remembered %d sends, want %d", len(c.sends), bbrMaxSends)
+	}
+	if _, ok := c.lookupSend(now); !ok {
+		t.Fatalf("forgot the latest send")
+	}
+	if _, ok := c.lookupSend(start.Add(time.Microsecond)); ok {
+		t.Fatalf("remembered the oldest send")
+	}
+
+	// Sends beyond the horizon of forgetSends are forgotten as soon as
+	// another packet is sent.
+	now = now.Add(time.Minute)
+	c.Sent(1200, 0, now)
+	if len(c.sends) != 1 {
+		t.Fatalf("remembered %d sends, want %d", len(c.sends), 1)
+	}
+}
@@ -0,0 +1,135 @@
+package quic
+
+import (
+	"math"
+	"time"
+)
+
+// Constants of CUBIC, see RFC 9438, Section 4.
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+
+	// The additive increase of the Reno-friendly estimate, in packets per
+	// RTT.
+	cubicAlpha = 3 * (1 - cubicBeta) / (1 + cubicBeta)
+)
+
+// See RFC 9438. The window is in bytes, but the cubic function works in
+// packets, like in the RFC.
+type cubicCongestionController struct {
+	maxPacketSize int
+	rtt           RTTStats
+
+	cwnd      int
+	ssthresh  int
+	recovery  time.Time
+	validated time.Time
+
+	// State of the current congestion avoidance epoch, which starts on
+	// congestion.
+	epoch   time.Time
+	wMax    float64 // window before the congestion, in packets
+	k       float64 // time for the window to grow back to wMax, in seconds
+	wEst    float64 // Reno-friendly window estimate, in packets
+	inEpoch bool
+}
+
+// NewCUBICCongestionController returns the CUBIC congestion controller. After
+// congestion, CUBIC grows the window as a cubic function of time, quickly back
+// to the size it had before the congestion and cautiously beyond. The growth
+// doesn't depend on the RTT, which makes CUBIC fill long fat links faster than
+// NewReno.
+func NewCUBICCongestionController(maxPacketSize int, rtt RTTStats, now time.Time) CongestionController {
+	return &cubicCongestionController{
+		maxPacketSize: maxPacketSize,
+		rtt:           rtt,
+
+		cwnd:      initialCwnd * maxPacketSize,
+		ssthresh:  math.MaxInt,
+		recovery:  now,
+		validated: now,
+	}
+}
+
+func (c *cubicCongestionController) Sent(size, padding int, now time.Time) {}
+
+// window returns the cubic function's window t seconds into the epoch, in
+// packets.
+func (c *cubicCongestionController) window(t float64) float64 {
+	return cubicC*math.Pow(t-c.k, 3) + c.wMax
+}
+
+func (c *cubicCongestionController) Ack(size int, sent, now time.Time) {
+	if sent.Before(c.recovery) {
+		return
+	}
+
+	if c.cwnd < c.ssthresh {
+		c.cwnd += size
+		return
+	}
+
+	// ssthresh is only ever lowered on congestion, which starts an epoch.
+	mss := float64(c.maxPacketSize)
+	cwnd := float64(c.cwnd) / mss
+	t := now.Sub(c.epoch).Seconds()
+
+	c.wEst += cubicAlpha * float64(size) / mss / cwnd
+	if c.window(t) < c.wEst {
+		// The Reno-friendly region
+		c.cwnd = max(c.cwnd, int(c.wEst*mss))
+		return
+	}
+
+	target := c.window(t + c.rtt.SmoothedRTT().Seconds())
+	target = math.Min(math.Max(target, cwnd), 1.5*cwnd)
+	c.cwnd += int((target - cwnd) / cwnd * float64(size))
+}
+
+func (c *cubicCongestionController) Loss(size int, sent, now time.Time) {
+	c.Congestion(sent, now)
+}
+
+func (c *cubicCongestionController) Congestion(sent, now time.Time) {
+	if sent.Before(c.recovery) {
+		return
+	}
+	c.recovery = now
+
+	mss := float64(c.maxPacketSize)
+	cwnd := float64(c.cwnd) / mss
+	wMax := cwnd
+	if c.inEpoch && cwnd < c.wMax {
+		// Fast convergence: release bandwidth to the flows that
+		// started more recently.
+		wMax = cwnd * (1 + cubicBeta) / 2
+	}
+
+	c.ssthresh = max(int(float64(c.cwnd)*cubicBeta), initialCwnd*c.maxPacketSize)
+	c.cwnd = c.ssthresh
+	c.startEpoch(wMax, now)
+}
+
+// startEpoch starts a congestion avoidance epoch, in which the window grows
+// back to wMax packets.
+func (c *cubicCongestionController) startEpoch(wMax float64, now time.Time) {
+	cwnd := float64(c.cwnd) / float64(c.maxPacketSize)
+
+	c.epoch = now
+	c.wMax = wMax
+	c.k = math.Cbrt(math.Max(wMax-cwnd, 0) / cubicC)
+	c.wEst = cwnd
+	c.inEpoch = true
+}
+
+func (c *cubicCongestionController) Cwnd() int { return c.cwnd }
+
+func (c *cubicCongestionController) CwndLimited(inFlightBytes int, now time.Time) bool {
+	return inFlightBytes+c.maxPacketSize > validatedCwnd(c.cwnd, inFlightBytes, c.maxPacketSize, c.validated, c.rtt.PTO(), now)
+}
+
+func (c *cubicCongestionController) Validate(inFlightBytes int, now time.Time) {
+	c.cwnd = validatedCwnd(c.cwnd, inFlightBytes, c.maxPacketSize, c.validated, c.rtt.PTO(), now)
+	c.validated = now
+}
@@ -0,0 +1,81 @@
+package quic
+
+import (
+	"math"
+	"time"
+)
+
+// renoBeta is the factor the congestion window is reduced by on congestion.
+const renoBeta = 0.5
+
+// See RFC 9002, Section 7.
+type renoCongestionController struct {
+	maxPacketSize int
+	rtt           RTTStats
+
+	cwnd       int
+	ssthresh   int
+	bytesAcked int // acked since cwnd was last grown in congestion avoidance
+	recovery   time.Time
+	validated  time.Time
+}
+
+// NewRenoCongestionController returns the NewReno congestion controller, which
+// grows the congestion window by the bytes acked during slow start, and by a
+// packet per window afterwards. It halves the window on congestion.
+func NewRenoCongestionController(maxPacketSize int, rtt RTTStats, now time.Time) CongestionController {
+	return &renoCongestionController{
+		maxPacketSize: maxPacketSize,
+		rtt:           rtt,
+
+		cwnd:      initialCwnd * maxPacketSize,
+		ssthresh:  math.MaxInt,
+		recovery:  now,
+		validated: now,
+	}
+}
+
+func (c *renoCongestionController) Sent(size, padding int, now time.Time) {}
+
+func (c *renoCongestionController) Ack(size int, sent, now time.Time) {
+	if sent.Before(c.recovery) {
+		return
+	}
+
+	if c.cwnd < c.ssthresh {
+		c.cwnd += size
+		return
+	}
+
+	c.bytesAcked += size
+	if c.bytesAcked >= c.cwnd {
+		c.bytesAcked -= c.cwnd
+		c.cwnd += c.maxPacketSize
+	}
+}
+
+func (c *renoCongestionController) Loss(size int, sent, now time.Time) {
+	c.Congestion(sent, now)
+}
+
+func (c *renoCongestionController) Congestion(sent, now time.Time) {
+	if sent.Before(c.recovery) {
+		return
+	}
+
+	c.recovery = now
+	c.ssthresh = max(int(float64(c.cwnd)*renoBeta), initialCwnd*c.maxPacketSize)
+	c.cwnd = c.ssthresh
+	c.bytesAcked = 0
+}
+
+func (c *renoCongestionController) Cwnd() int { return c.cwnd }
+
+func (c *renoCongestionController) CwndLimited(inFlightBytes int, now time.Time) bool {
+	return inFlightBytes+c.maxPacketSize > validatedCwnd(c.cwnd, inFlightBytes, c.maxPacketSize, c.validated, c.rtt.PTO(), now)
+}
+
+func (c *renoCongestionController) Validate(inFlightBytes int, now time.Time) {
+	c.cwnd = validatedCwnd(c.cwnd, inFlightBytes, c.maxPacketSize, c.validated, c.rtt.PTO(), now)
+	c.validated = now
+}
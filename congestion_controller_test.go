@@ -0,0 +1,175 @@
+package quic
+
+import (
+	"testing"
+	"time"
+)
+
+type fixedRTTStats struct {
+	minRTT, smoothedRTT, pto time.Duration
+}
+
+func (rtt fixedRTTStats) MinRTT() time.Duration      { return rtt.minRTT }
+func (rtt fixedRTTStats) SmoothedRTT() time.Duration { return rtt.smoothedRTT }
+func (rtt fixedRTTStats) PTO() time.Duration         { return rtt.pto }
+
+var testRTTStats = fixedRTTStats{100 * time.Millisecond, 100 * time.Millisecond, 300 * time.Millisecond}
+
+type congestionControllerStep struct {
+	loss      bool // ack otherwise
+	n         int  // times the step is repeated
+	sent, now time.Duration
+
+	minCwnd, maxCwnd int // after the step
+}
+
+var congestionControllerTests = []struct {
+	name                    string
+	newCongestionController func(maxPacketSize int, rtt RTTStats, now time.Time) CongestionController
+	steps                   []congestionControllerStep
+}{
+	{
+		name:                    "default",
+		newCongestionController: newCongestionController,
+		steps: []congestionControllerStep{
+			{n: 2, sent: 0, now: 100 * time.Millisecond, minCwnd: 4000, maxCwnd: 4000},
+			{loss: true, n: 1, sent: 10 * time.Millisecond, now: 200 * time.Millisecond, minCwnd: 2000, maxCwnd: 2000},
+			{loss: true, n: 1, sent: 50 * time.Millisecond, now: 210 * time.Millisecond, minCwnd: 2000, maxCwnd: 2000}, // same congestion event
+			{n: 1, sent: 100 * time.Millisecond, now: 250 * time.Millisecond, minCwnd: 2000, maxCwnd: 2000},            // sent before the congestion
+			{n: 1, sent: 220 * time.Millisecond, now: 300 * time.Millisecond, minCwnd: 3000, maxCwnd: 3000},
+		},
+	},
+	{
+		name:                    "NewReno",
+		newCongestionController: NewRenoCongestionController,
+		steps: []congestionControllerStep{
+			{n: 6, sent: 0, now: 100 * time.Millisecond, minCwnd: 8000, maxCwnd: 8000}, // slow start
+			{loss: true, n: 1, sent: 10 * time.Millisecond, now: 200 * time.Millisecond, minCwnd: 4000, maxCwnd: 4000},
+			{loss: true, n: 1, sent: 50 * time.Millisecond, now: 210 * time.Millisecond, minCwnd: 4000, maxCwnd: 4000},
+			{n: 1, sent: 100 * time.Millisecond, now: 250 * time.Millisecond, minCwnd: 4000, maxCwnd: 4000},
+			{n: 3, sent: 220 * time.Millisecond, now: 300 * time.Millisecond, minCwnd: 4000, maxCwnd: 4000}, // congestion avoidance
+			{n: 1, sent: 220 * time.Millisecond, now: 300 * time.Millisecond, minCwnd: 5000, maxCwnd: 5000}, // a window was acked
+			{n: 4, sent: 300 * time.Millisecond, now: 400 * time.Millisecond, minCwnd: 5000, maxCwnd: 5000},
+			{loss: true, n: 1, sent: 300 * time.Millisecond, now: 410 * time.Millisecond, minCwnd: 2500, maxCwnd: 2500},
+			{loss: true, n: 1, sent: 420 * time.Millisecond, now: 500 * time.Millisecond, minCwnd: 2000, maxCwnd: 2000}, // not below the initial window
+		},
+	},
+	{
+		name:                    "CUBIC",
+		newCongestionController: NewCUBICCongestionController,
+		steps: []congestionControllerStep{
+			{n: 8, sent: 0, now: 100 * time.Millisecond, minCwnd: 10000, maxCwnd: 10000}, // slow start
+			{loss: true, n: 1, sent: 10 * time.Millisecond, now: time.Second, minCwnd: 7000, maxCwnd: 7000},
+			{loss: true, n: 1, sent: 50 * time.Millisecond, now: time.Second, minCwnd: 7000, maxCwnd: 7000},
+			{n: 1, sent: 500 * time.Millisecond, now: 1100 * time.Millisecond, minCwnd: 7000, maxCwnd: 7000},
+			// The window is concave, and grows faster than NewReno's
+			// right after the congestion.
+			{n: 1, sent: 1100 * time.Millisecond, now: 1200 * time.Millisecond, minCwnd: 7100, maxCwnd: 7300},
+		},
+	},
+}
+
+func TestCongestionController(t *testing.T) {
+	const maxPacketSize = 1000
+
+	for _, test := range congestionControllerTests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Date(2000, 1, 1, 1, 1, 1, 0, time.UTC)
+			cc := test.newCongestionController(maxPacketSize, testRTTStats, start)
+			if cwnd := cc.Cwnd(); cwnd != initialCwnd*maxPacketSize {
+				t.Fatalf("initial cwnd = %d, want %d", cwnd, initialCwnd*maxPacketSize)
+			}
+
+			for i, step := range test.steps {
+				for j := 0; j < step.n; j++ {
+					if step.loss {
+						cc.Loss(maxPacketSize, start.Add(step.sent), start.Add(step.now))
+					} else {
+						cc.Ack(maxPacketSize, start.Add(step.sent), start.Add(step.now))
+					}
+				}
+				if cwnd := cc.Cwnd(); cwnd < step.minCwnd || step.maxCwnd < cwnd {
+					t.Fatalf("%d: cwnd = %d, want in [%d, %d]", i, cwnd, step.minCwnd, step.maxCwnd)
+				}
+			}
+		})
+	}
+}
+
+// TestCongestion checks that the congestion controllers react to CE marks like
+// to a loss.
+func TestCongestion(t *testing.T) {
+	const maxPacketSize = 1000
+
+	for _, test := range congestionControllerTests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Date(2000, 1, 1, 1, 1, 1, 0, time.UTC)
+			lossy := test.newCongestionController(maxPacketSize, testRTTStats, start)
+			marked := test.newCongestionController(maxPacketSize, testRTTStats, start)
+			for _, cc := range []CongestionController{lossy, marked} {
+				for i := 0; i < 8; i++ {
+					cc.Ack(maxPacketSize, start, start.Add(100*time.Millisecond))
+				}
+			}
+
+			lossy.Loss(maxPacketSize, start.Add(10*time.Millisecond), start.Add(200*time.Millisecond))
+			marked.Congestion(start.Add(10*time.Millisecond), start.Add(200*time.Millisecond))
+			if marked.Cwnd() != lossy.Cwnd() || marked.Cwnd() >= 10*maxPacketSize {
+				t.Fatalf("cwnd = %d, want %d", marked.Cwnd(), lossy.Cwnd())
+			}
+		})
+	}
+}
+
+// TestCUBICRecovery checks that CUBIC grows the window back to the size it had
+// before the congestion in K seconds, see RFC 9438, Section 4.2, and probes for
+// more bandwidth afterwards.
+func TestCUBICRecovery(t *testing.T) {
+	const maxPacketSize = 1000
+
+	start := time.Date(2000, 1, 1, 1, 1, 1, 0, time.UTC)
+	cc := NewCUBICCongestionController(maxPacketSize, testRTTStats, start)
+	for cc.Cwnd() < 100*maxPacketSize {
+		cc.Ack(maxPacketSize, start, start)
+	}
+	congestion := start.Add(time.Second)
+	cc.Loss(maxPacketSize, start, congestion)
+	k := cc.(*cubicCongestionController).k
+
+	// Ack a window of packets every RTT.
+	now := congestion
+	for now.Sub(congestion).Seconds() < k {
+		sent := now
+		now = now.Add(testRTTStats.smoothedRTT)
+		for acks := cc.Cwnd() / maxPacketSize; acks > 0; acks-- {
+			cc.Ack(maxPacketSize, sent, now)
+		}
+	}
+	if cwnd := cc.Cwnd(); cwnd < 95*maxPacketSize || 105*maxPacketSize < cwnd {
+		t.Fatalf("cwnd %v after the congestion = %d, want about %d", now.Sub(congestion), cwnd, 100*maxPacketSize)
+	}
+
+	for i := 0; i < 30; i++ {
+		sent := now
+		now = now.Add(testRTTStats.smoothedRTT)
+		for acks := cc.Cwnd() / maxPacketSize; acks > 0; acks-- {
+			cc.Ack(maxPacketSize, sent, now)
+		}
+	}
+	if cwnd := cc.Cwnd(); cwnd <= 110*maxPacketSize {
+		t.Fatalf("cwnd = %d, want it to grow beyond %d", cwnd, 100*maxPacketSize)
+	}
+
+	// Fast convergence: congestion before the window got back lowers the
+	// window the next epoch grows to.
+	cc.Loss(maxPacketSize, now, now)
+	cwnd := float64(cc.Cwnd()) / maxPacketSize
+	wMax := cc.(*cubicCongestionController).wMax
+	if wMax <= cwnd {
+		t.Fatalf("wMax = %v, want above %v", wMax, cwnd)
+	}
+	cc.Loss(maxPacketSize, now.Add(time.Millisecond), now.Add(time.Second))
+	if w := cc.(*cubicCongestionController).wMax; w >= cwnd {
+		t.Fatalf("wMax after fast convergence = %v, want below %v", w, cwnd)
+	}
+}
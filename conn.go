@@ -1,14 +1,20 @@
 package quic
 
 import (
+	"context"
+	"errors"
 	"io"
 	"log"
+	"math"
 	"math/rand"
+	"net"
 	"net/netip"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/nanokatze/quic-at-home/internal/sec"
+	"github.com/nanokatze/quic-at-home/internal/udp"
 	"github.com/nanokatze/quic-at-home/internal/wire"
 )
 
@@ -23,21 +29,40 @@ const (
 )
 
 // maxRcvdPacketNumberRangeCount limits how many received packet number ranges
-// are kept track of.
-//
-// TODO: increase maxRcvdPacketNumberRangeCount when ACK can be truncated to
-// fit the packet.
-const maxRcvdPacketNumberRangeCount = 8
+// are kept track of, so that a peer skipping packet numbers can't make us use
+// unbounded memory. ACK frames carry as many of the greatest ranges as fit.
+const maxRcvdPacketNumberRangeCount = 1024
 
-const maxAckedPacketNumberRangeCount = maxRcvdPacketNumberRangeCount
+// ErrLingerTimeout is returned by CloseContext and Close if the connection had
+// to be closed before the peer acknowledged all stream data.
+var ErrLingerTimeout = errors.New("linger timeout: stream data left unacknowledged")
+
+// ErrMsgTooLarge is returned by WriteMsg if the message would not fit in the
+// peer's message receive window.
+var ErrMsgTooLarge = errors.New("message exceeds the peer's message receive window")
+
+// ErrIdleTimeout is the error a connection is closed with when nothing was
+// received from the peer for the negotiated idle timeout.
+var ErrIdleTimeout = errors.New("idle timeout")
 
 // maxTimeoutBackoff specifies the maximum timeout backoff, in powers of two.
 const maxTimeoutBackoff = 5
 
+// A key update is initiated once keyUpdatePackets packets were sent with the
+// current keys or keyUpdateInterval has passed since the last update, whichever
+// comes first.
+const keyUpdateInterval = 2 * time.Minute
+
+// keyUpdatePackets is a variable, so that tests can have keys updated often. A
+// connection reads it once, as it is created.
+var keyUpdatePackets wire.PacketNumber = 1 << 20
+
 // minMigrationProbeInterval specifies how often a migration probe can be sent,
 // per connection.
 const minMigrationProbeInterval = time.Second / 3
 
+var _ net.Conn = (*Conn)(nil)
+
 type Conn struct {
 	mux *Mux
 	id  wire.ConnID
@@ -46,24 +71,65 @@ type Conn struct {
 	closed   chan struct{}
 	closeErr error
 
+	closeFrame wire.Close // CLOSE frame to send once closed
+
+	remoteStaticPublicKey PublicKey
+	handshakeHash         []byte
+	handshakePayload      []byte // the peer's
+	protocol              string
+
 	// TODO: rename these
 
-	relrcvready   chan struct{} // you've got data!
-	relsndready   chan struct{}
+	acceptready   chan struct{}
+	openready     chan struct{}
+	drainready    chan struct{}
 	unrelrcvready chan struct{}
 	unrelsndready chan struct{}
 	wakeup        chan struct{}
 
+	// Deadlines of the default stream and the message ReadWriter.
+	readDeadline  *deadline
+	writeDeadline *deadline
+
 	mu sync.Mutex // protects following fields
 
+	// Set once c is being closed gracefully. Writes are not accepted
+	// anymore.
+	draining bool
+
 	recvAEAD, sendAEAD sec.AEAD
 
+	// The packet number and the key phase bit are masked with header
+	// protection, so that observers can't count packets or tell key
+	// updates. The packet type bits are left unmasked: Mux routes packets
+	// by type before it knows which connection they belong to.
+	recvHP, sendHP sec.HeaderProtection
+
+	// Each direction updates its keys independently. The sender updates
+	// keys on its own accord and flips the key phase bit of the packets it
+	// sends, and the receiver follows. The sender doesn't update keys again
+	// until the receiver acks a packet protected with the current keys, so
+	// the receiver can tell a key update from a reordered packet. Packet
+	// numbers keep increasing across key updates, so nonces never repeat.
+
+	sendKeyPhase        bool
+	sendKeyPhaseStartPN wire.PacketNumber // first packet number sent with the current keys
+	sendKeyPhaseAcked   bool              // a packet sent with the current keys was acked
+	sendKeyUpdateTime   time.Time
+	keyUpdatePackets    wire.PacketNumber
+
+	recvKeyPhase        bool
+	recvKeyPhaseStartPN wire.PacketNumber // packet number the current keys were switched to at
+	nextRecvAEAD        sec.AEAD
+	prevRecvAEAD        sec.AEAD // nil once discarded
+	prevRecvAEADExpiry  time.Time
+
 	// Packet number counter
 	seq int64
 	// Maximum packet number that the peer acked
 	maxPNAcked wire.PacketNumber
-	// The last several received packet number ranges, at most
-	// maxRcvdPacketNumberRangeCount long.
+	// The received packet number ranges the peer may not know we received,
+	// at most maxRcvdPacketNumberRangeCount long.
 	maxRcvdPNRanges wire.PacketNumberRanges
 	// Time maxRcvdPNRanges.Max() was received.
 	maxRcvdPNRcvTime time.Time
@@ -73,23 +139,59 @@ type Conn struct {
 	// ∑_pn inFlightPackets[pn].size
 	inFlightBytes int
 
-	congestionController *congestionController
+	congestionController CongestionController
 	rttFilter            *rttFilter
 
+	pacer pacer
+
+	pmtud pmtuDiscoverer
+
+	ecn ecnValidator
+	// Counts of the packets received with each ECN codepoint, reported
+	// back in ACKs.
+	ecnCounts wire.ECNCounts
+
+	padder padder // nil if packets aren't padded
+
 	timeoutBackoff int
 	timeout        time.Time // when time-based loss detection will be triggered
 
 	sendAckBy   time.Time
 	sentTailAck bool
 
-	streamReassembler    *streamReassembler
-	maxStreamOffAcked    int64 // max stream offset that the peer acked
-	maxStreamOffInFlight int64
-
-	streamFragments     []streamFragment
-	streamOff           int64
-	maxStreamOff        int64 // peer's max stream offset
-	streamBytesInFlight int   // == ∑_pn ∑ᵢ len(inFlightPackets[pn].streamFragments[i].data) + ∑ᵢ len(streamFragments[i].data)
+	maxPacketSize           int           // negotiated, the path may only deliver smaller packets, see pmtud
+	maxAckDelay             time.Duration // ours
+	peerMaxAckDelay         time.Duration
+	peerInitialStreamWindow int64
+	peerMsgWindow           int
+
+	// Negotiated idle timeout and keep-alive period, zero if disabled.
+	idleTimeout     time.Duration
+	keepAlivePeriod time.Duration
+	// Time a packet was last received from the peer.
+	lastRcvTime time.Time
+	// Time a keep-alive PING was last sent.
+	lastKeepAliveTime time.Time
+
+	// The default stream, which Read and Write operate on. Both peers have
+	// it open from the start.
+	stream *Stream
+
+	streams          map[int64]*Stream
+	nextStreamID     int64 // ID of the next locally initiated stream
+	nextPeerStreamID int64 // ID of the next stream the peer might initiate
+	incomingStreams  []*Stream
+
+	// Stream limits count the streams opened since the start of the
+	// connection, the default stream excluded. A peer raises the limit of
+	// the streams the other peer may open with MAX_STREAMS as the streams
+	// get done with, so that only so many of them are open at once.
+	streamCount            int64 // number of streams we opened
+	peerMaxStreams         int64 // number of streams the peer lets us open
+	peerStreamCount        int64 // number of streams the peer opened
+	maxPeerStreams         int64 // number of streams we let the peer open
+	maxPeerStreamsAcked    int64 // max MAX_STREAMS that the peer acked
+	maxPeerStreamsInFlight int64
 
 	msgReassembler *msgReassembler
 	msgRcvdSeq     int64
@@ -121,53 +223,51 @@ type Conn struct {
 	bytesNacked        int64
 	bytesTimedOut      int64
 	tailAcksSent       int64
+	keyUpdates         int64
+	paddingBytesSent   int64
 	streamBytesWritten int64
 	msgBytesWritten    int64
 }
 
 type inFlightPacket struct {
-	maxPNAcks       wire.PacketNumber // max packet number this packet acknowledges
-	maxStreamOff    int64
+	acks            wire.PacketNumberRanges // the ranges the ACK in this packet reports, but the greatest
+	maxStreams      int64                   // MAX_STREAMS this packet carries, or 0
+	maxStreamData   []wire.MaxStreamData
 	streamFragments []streamFragment
 	containsMsg     bool
+	containsPing    bool
 	paddr           netip.AddrPort
+	ecn             bool // marked ECT(0)
+	pmtuProbe       bool
 	sent            time.Time
 	size            int
+	padding         int // bytes of size that are padding
 }
 
 func (p inFlightPacket) AckEliciting() bool {
-	return p.maxStreamOff > 0 || len(p.streamFragments) > 0 || p.containsMsg || p.paddr.IsValid()
+	return p.maxStreams > 0 || len(p.maxStreamData) > 0 || len(p.streamFragments) > 0 || p.containsMsg || p.containsPing || p.paddr.IsValid()
 }
 
-type streamFragment struct {
-	data []byte
-	off  int64
-}
-
-func (f streamFragment) Split(i int) (streamFragment, streamFragment) {
-	g := streamFragment{
-		data: f.data[i:],
-		off:  f.off + int64(i),
-	}
-	f.data = f.data[:i]
-	return f, g
-}
-
-func newConn(mux *Mux, cid wire.ConnID, recvAEAD, sendAEAD sec.AEAD, raddr netip.AddrPort) *Conn {
+func newConn(mux *Mux, cid wire.ConnID, recvAEAD, sendAEAD sec.AEAD, recvHP, sendHP sec.HeaderProtection, raddr netip.AddrPort, isClient bool, peerParams wire.TransportParameters) *Conn {
 	c := &Conn{
 		mux: mux,
 		id:  cid,
 
 		closed: make(chan struct{}),
 
-		relrcvready:   make(chan struct{}, 1),
-		relsndready:   make(chan struct{}, 1),
+		acceptready:   make(chan struct{}, 1),
+		openready:     make(chan struct{}, 1),
+		drainready:    make(chan struct{}, 1),
 		unrelrcvready: make(chan struct{}, 1),
 		unrelsndready: make(chan struct{}, 1),
 		wakeup:        make(chan struct{}, 1),
 
 		recvAEAD: recvAEAD,
 		sendAEAD: sendAEAD,
+		recvHP:   recvHP,
+		sendHP:   sendHP,
+
+		nextRecvAEAD: recvAEAD.Rekey(),
 
 		seq: rand.Int63n(3),
 
@@ -175,21 +275,58 @@ func newConn(mux *Mux, cid wire.ConnID, recvAEAD, sendAEAD sec.AEAD, raddr netip
 
 		inFlightPackets: make(map[wire.PacketNumber]inFlightPacket),
 
-		streamReassembler: newStreamReassembler(mux.config.StreamReceiveWindow),
+		streams: make(map[int64]*Stream),
 
-		msgReassembler: newMsgReassembler(0),
+		msgReassembler: newMsgReassembler(mux.config.MsgReceiveWindow),
 		msgRcvdSeq:     -2,
 
 		msgSeq: rand.Int63n(3),
+
+		maxPacketSize:           min(mux.config.maxPacketSize(), max(peerParams.MaxPacketSize, minPacketSize)),
+		maxAckDelay:             mux.config.maxAckDelay(),
+		peerMaxAckDelay:         defaultMaxAckDelay,
+		peerInitialStreamWindow: peerParams.InitialStreamWindow,
+		peerMsgWindow:           int(min(peerParams.MsgWindow, math.MaxInt)),
+
+		peerMaxStreams:      peerParams.MaxStreams,
+		maxPeerStreams:      int64(mux.config.maxIncomingStreams()),
+		maxPeerStreamsAcked: int64(mux.config.maxIncomingStreams()),
+
+		idleTimeout:     minNonZero(mux.config.MaxIdleTimeout, peerParams.MaxIdleTimeout),
+		keepAlivePeriod: minNonZero(mux.config.KeepAlivePeriod, peerParams.KeepAlivePeriod),
+		lastRcvTime:     time.Now(),
+	}
+	c.sendKeyPhaseStartPN = wire.PacketNumber(c.seq)
+	if policy := mux.config.PaddingPolicy; policy != nil {
+		c.padder = policy.newPadder()
+	}
+	c.sendKeyUpdateTime = time.Now()
+	c.keyUpdatePackets = keyUpdatePackets
+
+	if peerParams.MaxAckDelay != 0 {
+		c.peerMaxAckDelay = peerParams.MaxAckDelay
 	}
 	c.setRemoteAddr(raddr, time.Time{})
 
+	// Streams initiated by the dialing peer have even IDs, and streams
+	// initiated by the listening peer have odd IDs.
+	c.stream = newStream(c, 0)
+	c.streams[0] = c.stream
+	c.readDeadline, c.writeDeadline = c.stream.readDeadline, c.stream.writeDeadline
+	if isClient {
+		c.nextStreamID, c.nextPeerStreamID = 2, 1
+	} else {
+		c.nextStreamID, c.nextPeerStreamID = 1, 2
+	}
+
 	return c
 }
 
 func (c *Conn) setRemoteAddr(raddr netip.AddrPort, now time.Time) {
-	c.congestionController = newCongestionController(now)
-	c.rttFilter = newRTTFilter()
+	c.rttFilter = newRTTFilter(c.peerMaxAckDelay)
+	c.congestionController = c.mux.config.newCongestionController(c.maxPacketSize, c.rttFilter, now)
+	c.ecn = ecnValidator{} // the new path may not support ECN
+	c.pmtud = newPMTUDiscoverer(c.maxPacketSize)
 
 	c.migrationAddr = netip.AddrPort{}
 	c.migrationProbeCooldown = now.Add(minMigrationProbeInterval)
@@ -197,90 +334,103 @@ func (c *Conn) setRemoteAddr(raddr netip.AddrPort, now time.Time) {
 	c.raddr = raddr
 }
 
-// If c is closed, Read will read remaining stream contents before reporting an
-// error.
-func (c *Conn) Read(b []byte) (int, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// Read reads from the default stream. If c is closed, Read will read remaining
+// stream contents before reporting an error.
+func (c *Conn) Read(b []byte) (int, error) { return c.stream.Read(b) }
 
-	for {
-		n, _ := c.streamReassembler.Read(b)
-		if n == 0 {
-			c.mu.Unlock()
-			select {
-			case <-c.relrcvready:
-				c.mu.Lock()
-				continue
-			case <-c.closed:
-				c.mu.Lock()
-				return 0, c.closeErr
-			}
-		}
+// Write writes to the default stream.
+func (c *Conn) Write(b []byte) (int, error) { return c.stream.Write(b) }
 
-		select {
-		case c.wakeup <- struct{}{}:
-		default:
-		}
-		c.streamBytesRead += int64(n)
-		return n, nil
-	}
+// CloseWrite closes the default stream for writing.
+func (c *Conn) CloseWrite() error { return c.stream.CloseWrite() }
+
+// RemoteStaticPublicKey returns the static public key the peer authenticated
+// with during the handshake.
+func (c *Conn) RemoteStaticPublicKey() PublicKey {
+	return slices_Clone(c.remoteStaticPublicKey)
 }
 
-func (c *Conn) Write(b []byte) (int, error) {
-	select {
-	default:
-	case <-c.closed:
-		return 0, c.closeErr
-	}
+// HandshakeHash returns the Noise handshake hash, which uniquely identifies the
+// handshake c was established with. It is the same for both peers and can be
+// used for channel binding.
+func (c *Conn) HandshakeHash() []byte {
+	return slices_Clone(c.handshakeHash)
+}
 
-	// TODO: evaluate whether to optimize for small writes
+// HandshakePayload returns the application payload the peer sent in its
+// handshake message: for the dialing side, the payload returned by the peer's
+// Config.ResponsePayload, and for the accepting side, the payload passed to the
+// peer's DialContextAddrPort.
+func (c *Conn) HandshakePayload() []byte {
+	return slices_Clone(c.handshakePayload)
+}
 
-	// Avoid retaining b.
-	b = slices_Clone(b)
+// Protocol returns the application protocol selected during the handshake, or
+// an empty string if none was, see Config.Protocols.
+func (c *Conn) Protocol() string {
+	return c.protocol
+}
 
+// LocalAddrPort returns the local address of the Mux c belongs to.
+func (c *Conn) LocalAddrPort() netip.AddrPort {
+	return c.mux.LocalAddrPort()
+}
+
+// RemoteAddrPort returns the peer's address. The address changes if the peer
+// migrates.
+func (c *Conn) RemoteAddrPort() netip.AddrPort {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	n := 0
-	for n < len(b) {
-		nn := min(int(min(int64(len(b)-n), c.maxStreamOff-c.streamOff)), c.mux.config.MaxStreamBytesInFlight-c.streamBytesInFlight)
-		if nn == 0 {
-			c.mu.Unlock()
-			select {
-			case <-c.relsndready:
-				c.mu.Lock()
-				continue
-			case <-c.closed:
-				c.mu.Lock()
-				return n, c.closeErr
-			}
-		}
+	return c.raddr
+}
 
-		if wire.MaxVarint-c.streamOff < int64(nn) {
-			panic("stream offset wraparound")
-		}
-		c.streamFragments = append(c.streamFragments, streamFragment{
-			data: b[n : n+nn],
-			off:  c.streamOff,
-		})
-		c.streamOff += int64(nn)
-		c.streamBytesInFlight += nn
+// LocalAddr returns the local address of the Mux c belongs to.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.mux.pconn.LocalAddr()
+}
 
-		select {
-		case c.wakeup <- struct{}{}:
-		default:
-		}
+// RemoteAddr returns the peer's address. The address changes if the peer
+// migrates.
+func (c *Conn) RemoteAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.RemoteAddrPort())
+}
 
-		c.streamBytesWritten += int64(nn)
+// PaddingBytesSent returns how many bytes of padding c sent so far, see
+// Config.PaddingPolicy.
+func (c *Conn) PaddingBytesSent() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-		n += nn
-	}
-	return n, nil
+	return c.paddingBytesSent
+}
+
+// SetDeadline sets the read and write deadlines of c, see net.Conn. The
+// deadlines apply to the default stream and the message ReadWriter; other
+// streams have their own deadlines.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for pending and future Read, ReadMsg calls.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for pending and future Write, WriteMsg and
+// ReadMsgFrom calls.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
 }
 
 // SetMsgReceiveWindow sets the receive window size of the message ReadWriter.
 // SetMsgReceiveWindow must not be called while the message ReadWriter is being
-// read or written to.
+// read or written to. Unlike Config.MsgReceiveWindow, the new window is not
+// advertised to the peer.
 func (c *Conn) SetMsgReceiveWindow(n int) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -289,8 +439,14 @@ func (c *Conn) SetMsgReceiveWindow(n int) {
 }
 
 func (c *Conn) ReadMsg(b []byte) (int, error) {
+	if c.readDeadline.expired() {
+		return 0, os.ErrDeadlineExceeded
+	}
+
 	select {
 	case <-c.unrelrcvready:
+	case <-c.readDeadline.done():
+		return 0, os.ErrDeadlineExceeded
 	case <-c.closed:
 		return 0, c.closeErr
 	}
@@ -303,9 +459,21 @@ func (c *Conn) ReadMsg(b []byte) (int, error) {
 	return n, nil
 }
 
+// WriteMsg sends b as a single message. If the peer advertised its message
+// receive window, and b doesn't fit in it, WriteMsg returns ErrMsgTooLarge.
 func (c *Conn) WriteMsg(b []byte) (int, error) {
+	if c.peerMsgWindow > 0 && len(b) > c.peerMsgWindow {
+		return 0, ErrMsgTooLarge
+	}
+
+	if c.writeDeadline.expired() {
+		return 0, os.ErrDeadlineExceeded
+	}
+
 	select {
 	case c.unrelsndready <- struct{}{}:
+	case <-c.writeDeadline.done():
+		return 0, os.ErrDeadlineExceeded
 	case <-c.closed:
 		return 0, c.closeErr
 	}
@@ -313,6 +481,11 @@ func (c *Conn) WriteMsg(b []byte) (int, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.draining {
+		<-c.unrelsndready
+		return 0, io.ErrClosedPipe
+	}
+
 	c.msgData = slices_Clone(b)
 	c.msgContinued = false
 
@@ -324,9 +497,21 @@ func (c *Conn) WriteMsg(b []byte) (int, error) {
 	return len(b), nil
 }
 
+// ReadMsgFrom reads a message of at most max bytes from r and sends it. If the
+// peer advertised its message receive window, max is capped to the window.
 func (c *Conn) ReadMsgFrom(r io.Reader, max int) (int, error) {
+	if c.peerMsgWindow > 0 && max > c.peerMsgWindow {
+		max = c.peerMsgWindow
+	}
+
+	if c.writeDeadline.expired() {
+		return 0, os.ErrDeadlineExceeded
+	}
+
 	select {
 	case c.unrelsndready <- struct{}{}:
+	case <-c.writeDeadline.done():
+		return 0, os.ErrDeadlineExceeded
 	case <-c.closed:
 		return 0, c.closeErr
 	}
@@ -347,6 +532,11 @@ func (c *Conn) ReadMsgFrom(r io.Reader, max int) (int, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.draining {
+		<-c.unrelsndready
+		return 0, io.ErrClosedPipe
+	}
+
 	c.msgData = msgBuf[:n]
 	c.msgContinued = false
 
@@ -367,7 +557,7 @@ func (c *Conn) run() {
 	go func() {
 		select {
 		case <-c.mux.closed:
-			c.Close()
+			c.closeWithError(io.ErrClosedPipe, nil)
 		case <-c.closed:
 		}
 	}()
@@ -386,57 +576,107 @@ func (c *Conn) run() {
 			return
 		}
 
-		sleepUntil := c.wake()
+		sleepUntil, err := c.wake()
+		if err != nil {
+			c.closeWithError(err, nil)
+			return
+		}
 		if sleepUntil < forever {
 			timer.Reset(sleepUntil)
 		}
 	}
 }
 
-func (c *Conn) wake() time.Duration {
+func (c *Conn) wake() (time.Duration, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	now := time.Now()
 
+	if c.idleTimeout > 0 && !now.Before(c.lastRcvTime.Add(c.idleTimeout)) {
+		// The peer is gone, or the path is broken. Close silently,
+		// there's likely no one to send CLOSE to.
+		return forever, ErrIdleTimeout
+	}
+
 	c.maybeScavengeTimedOutPackets(now)
 
-	buf := make([]byte, maxPacketSize) // TODO: sync.Pool for superbuffers?
+	// The packets of a batch are all of the same size, except the last.
+	size := c.pmtud.size
+	buf := make([]byte, size) // TODO: sync.Pool for superbuffers?
 	off := 0
+	ecn := c.ecn.codepoint() // for the whole batch
 	for {
 		// TODO: this condition doesn't seem necessary, could just use
 		// append in a more clever way
-		if len(buf) < off+maxPacketSize {
-			buf = append(buf, make([]byte, maxPacketSize)...)
+		if len(buf) < off+size {
+			buf = append(buf, make([]byte, size)...)
 		}
 
-		n, paddr := c.sendPacket(buf[off:off+maxPacketSize], now)
+		n, paddr := c.sendPacket(buf[off:off+size], ecn == udp.ECT0, now)
 		if paddr.IsValid() {
 			c.mux.pconn.WriteToUDPAddrPort(buf[off:off+n], paddr)
 		}
-		if n < maxPacketSize {
+		if n < size {
 			// TODO: flush buffer when the size gets to around 65k
-			c.mux.pconn.WriteToUDPAddrPortGSO(buf[:off+n], maxPacketSize, c.raddr)
+			c.mux.pconn.WriteToUDPAddrPortGSO(buf[:off+n], size, ecn, c.raddr)
 			break
 		}
 
 		select {
 		case <-c.closed:
-			return forever
+			return forever, nil
 		default:
 		}
 
 		off += n
 	}
 
+	// Probes are larger than the other packets, so they are sent on their
+	// own.
+	if !c.congestionController.CwndLimited(c.inFlightBytes, now) {
+		if size := c.pmtud.probe(now); size > 0 {
+			probe := make([]byte, size)
+			c.sendPMTUProbe(probe, now)
+			c.mux.pconn.WriteToUDPAddrPort(probe, c.raddr)
+		}
+	}
+
 	sleepUntil := forever
 	for _, t := range []time.Time{
 		c.timeout,
 		c.sendAckBy,
+		c.keepAliveTime(),
+		c.idleTime(),
+		c.pacer.NextSendTime(c.maxPacketSize, pacingRate(c.congestionController, c.rttFilter), now),
 	} {
-		sleepUntil = min(sleepUntil, t.Sub(now))
+		if !t.IsZero() {
+			sleepUntil = min(sleepUntil, t.Sub(now))
+		}
+	}
+	return sleepUntil, nil
+}
+
+// keepAliveTime returns when a keep-alive PING is to be sent, or zero time if
+// keep-alives are disabled.
+func (c *Conn) keepAliveTime() time.Time {
+	if c.keepAlivePeriod == 0 {
+		return time.Time{}
+	}
+	t := c.lastRcvTime
+	if t.Before(c.lastKeepAliveTime) {
+		t = c.lastKeepAliveTime
+	}
+	return t.Add(c.keepAlivePeriod)
+}
+
+// idleTime returns when c is to be closed for being idle, or zero time if the
+// idle timeout is disabled.
+func (c *Conn) idleTime() time.Time {
+	if c.idleTimeout == 0 {
+		return time.Time{}
 	}
-	return sleepUntil
+	return c.lastRcvTime.Add(c.idleTimeout)
 }
 
 func (c *Conn) maybeScavengeTimedOutPackets(now time.Time) {
@@ -459,18 +699,18 @@ func (c *Conn) maybeScavengeTimedOutPackets(now time.Time) {
 		delete(c.inFlightPackets, pn)
 		c.inFlightBytes -= p.size
 
-		c.congestionController.Loss(p.sent, now)
+		if p.pmtuProbe {
+			c.pmtud.probeLost(p.size, now)
+			continue
+		}
 
-		if c.maxStreamOffInFlight == p.maxStreamOff {
-			// This packet carried the maximum STREAM_MAX_OFFSET
-			// we've sent. We don't know what the one before it was,
-			// nor does it matter, just set the in-flight offset to
-			// something low.
-			c.maxStreamOffInFlight = 0
+		c.congestionController.Loss(p.size, p.sent, now)
+		if p.ecn {
+			c.ecn.lose()
 		}
+		c.pmtud.lost(p.size)
 
-		// TODO: keep c.streamFragments sorted
-		c.streamFragments = append(p.streamFragments, c.streamFragments...)
+		c.requeue(p)
 
 		c.bytesTimedOut += int64(p.size)
 
@@ -489,36 +729,138 @@ func (c *Conn) maybeScavengeTimedOutPackets(now time.Time) {
 	}
 }
 
+// requeue arranges for the stream data carried by a lost packet p to be sent
+// again.
+func (c *Conn) requeue(p inFlightPacket) {
+	if p.maxStreams > 0 && c.maxPeerStreamsInFlight == p.maxStreams {
+		c.maxPeerStreamsInFlight = 0
+	}
+
+	for _, m := range p.maxStreamData {
+		if s, ok := c.streams[m.ID]; ok && s.maxOffInFlight == m.Off {
+			// This packet carried the maximum MAX_STREAM_DATA
+			// we've sent. We don't know what the one before it was,
+			// nor does it matter, just set the in-flight offset to
+			// something low.
+			s.maxOffInFlight = 0
+		}
+	}
+
+	// TODO: keep s.fragments sorted
+	for i := len(p.streamFragments) - 1; i >= 0; i-- {
+		f := p.streamFragments[i]
+		if s, ok := c.streams[f.id]; ok {
+			s.fragments = append([]streamFragment{f}, s.fragments...)
+		}
+	}
+}
+
+// Close closes c. If Config.Linger is non-zero, Close is graceful, see
+// CloseContext.
 func (c *Conn) Close() error {
-	c.closeWithError(io.ErrClosedPipe)
+	if linger := c.mux.config.Linger; linger > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), linger)
+		defer cancel()
+		return c.CloseContext(ctx)
+	}
+
+	c.closeWithError(io.ErrClosedPipe, &wire.Close{Code: int64(NoError)})
+	return nil
+}
+
+// CloseWithError closes c, reporting code and reason to the peer. The peer's
+// operations on the connection will fail with an *ApplicationError carrying
+// them. code must be between 0 and 2⁶²-1 incl. The reason may get truncated to
+// fit in a packet, between UTF-8 encoded characters.
+func (c *Conn) CloseWithError(code uint64, reason string) error {
+	if code > wire.MaxVarint {
+		return errors.New("application error code out of range")
+	}
+	c.closeWithError(io.ErrClosedPipe, &wire.Close{
+		Application: true,
+		Code:        int64(code),
+		Reason:      []byte(reason),
+	})
+	return nil
+}
+
+// CloseContext closes c gracefully. c stops accepting writes, but keeps
+// retransmitting stream data until the peer acknowledges all of it, and only
+// then sends CLOSE. If ctx is done before that, c is closed regardless and
+// CloseContext returns ErrLingerTimeout. If c gets closed for another reason
+// in the meantime, CloseContext returns the reason.
+func (c *Conn) CloseContext(ctx context.Context) error {
+	c.mu.Lock()
+	c.draining = true
+	for c.hasUnackedStreamData() {
+		c.mu.Unlock()
+		select {
+		case <-c.drainready:
+			c.mu.Lock()
+		case <-c.closed:
+			return c.closeErr
+		case <-ctx.Done():
+			c.closeWithError(io.ErrClosedPipe, &wire.Close{Code: int64(NoError)})
+			return ErrLingerTimeout
+		}
+	}
+	c.mu.Unlock()
+
+	c.closeWithError(io.ErrClosedPipe, &wire.Close{Code: int64(NoError)})
 	return nil
 }
 
-func (c *Conn) closeWithError(err error) {
+// hasUnackedStreamData reports whether any of the data or FINs written to c's
+// streams are yet to be acknowledged.
+func (c *Conn) hasUnackedStreamData() bool {
+	for _, s := range c.streams {
+		if s.bytesInFlight > 0 || s.writeClosed && !s.finAcked {
+			return true
+		}
+	}
+	return false
+}
+
+// closeWithError closes c with err. If frame is not nil, it is sent to the
+// peer.
+func (c *Conn) closeWithError(err error, frame *wire.Close) {
 	c.once.Do(func() {
 		c.mux.conns.Delete(c.id)
 		c.closeErr = err
 		close(c.closed)
 
+		if frame != nil {
+			c.mu.Lock()
+			c.closeFrame = *frame
+			buf := make([]byte, c.pmtud.size)
+			n, _ := c.sendPacket(buf, false, time.Now()) // send CLOSE
+			c.mux.pconn.WriteToUDPAddrPort(buf[:n], c.raddr)
+			c.mu.Unlock()
+		}
+
 		c.mu.Lock()
-		buf := make([]byte, maxPacketSize)
-		n, _ := c.sendPacket(buf, time.Now()) // send CLOSE
-		c.mux.pconn.WriteToUDPAddrPort(buf[:n], c.raddr)
+		c.logStats()
 		c.mu.Unlock()
-
-		log.Print("bytes rcvd           ", c.bytesRcvd)
-		log.Print("stream bytes read    ", c.streamBytesRead)
-		log.Print("msg bytes read       ", c.msgBytesRead)
-		log.Print("msg bytes rcvd       ", c.msgBytesRcvd)
-		log.Print("bytes sent           ", c.bytesSent)
-		log.Print("bytes acked          ", c.bytesSent-c.bytesNacked-c.bytesTimedOut)
-		log.Print("bytes nacked         ", c.bytesNacked)
-		log.Print("bytes timed out      ", c.bytesTimedOut)
-		log.Print("tail acks sent       ", c.tailAcksSent)
-		log.Print("stream bytes written ", c.streamBytesWritten)
-		log.Print("msg bytes written    ", c.msgBytesWritten)
-		log.Printf("overhead %.2f%% loss %.2f%%",
-			100.0*(1.0-float64(c.streamBytesWritten+c.msgBytesWritten)/float64(c.bytesSent-c.bytesNacked-c.bytesTimedOut)),
-			100.0*(float64(c.bytesNacked+c.bytesTimedOut)/float64(c.bytesSent-c.bytesNacked-c.bytesTimedOut)))
 	})
 }
+
+// logStats logs the stats counters. c.mu must be held: the counters are
+// updated as packets are sent and received.
+func (c *Conn) logStats() {
+	log.Print("bytes rcvd           ", c.bytesRcvd)
+	log.Print("stream bytes read    ", c.streamBytesRead)
+	log.Print("msg bytes read       ", c.msgBytesRead)
+	log.Print("msg bytes rcvd       ", c.msgBytesRcvd)
+	log.Print("bytes sent           ", c.bytesSent)
+	log.Print("bytes acked          ", c.bytesSent-c.bytesNacked-c.bytesTimedOut)
+	log.Print("bytes nacked         ", c.bytesNacked)
+	log.Print("bytes timed out      ", c.bytesTimedOut)
+	log.Print("tail acks sent       ", c.tailAcksSent)
+	log.Print("key updates          ", c.keyUpdates)
+	log.Print("padding bytes sent   ", c.paddingBytesSent)
+	log.Print("stream bytes written ", c.streamBytesWritten)
+	log.Print("msg bytes written    ", c.msgBytesWritten)
+	log.Printf("overhead %.2f%% loss %.2f%%",
+		100.0*(1.0-float64(c.streamBytesWritten+c.msgBytesWritten)/float64(c.bytesSent-c.bytesNacked-c.bytesTimedOut)),
+		100.0*(float64(c.bytesNacked+c.bytesTimedOut)/float64(c.bytesSent-c.bytesNacked-c.bytesTimedOut)))
+}
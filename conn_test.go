@@ -0,0 +1,88 @@
+package quic
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nanokatze/quic-at-home/internal/wire"
+)
+
+// TestLinger checks that Close with Config.Linger keeps retransmitting the
+// stream data until the peer acknowledged all of it.
+func TestLinger(t *testing.T) {
+	srv, _ := newTestMux(t, Config{Listen: true})
+	cli, cliLoss := newTestMux(t, Config{Linger: 5 * time.Second})
+	c, sc := dialTestMux(t, cli, srv)
+	cliLoss.every.Store(5)
+
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(data); err == nil {
+		t.Fatalf("write after Close succeeded")
+	}
+
+	// The peer reads the data, and only then the close.
+	b, err := io.ReadAll(sc)
+	if !bytes.Equal(b, data) {
+		t.Fatalf("read %d bytes, want %d", len(b), len(data))
+	}
+	if err != io.ErrClosedPipe {
+		t.Fatalf("err = %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+// TestLingerTimeout checks that CloseContext gives up on the peer acknowledging
+// the stream data once ctx is done.
+func TestLingerTimeout(t *testing.T) {
+	srv, _ := newTestMux(t, Config{Listen: true})
+	cli, cliLoss := newTestMux(t, Config{})
+	c, _ := dialTestMux(t, cli, srv)
+	cliLoss.every.Store(1) // the peer receives nothing
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.CloseContext(ctx); err != ErrLingerTimeout {
+		t.Fatalf("err = %v, want %v", err, ErrLingerTimeout)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Fatalf("read after close: err = %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+// TestKeyUpdate checks that data keeps flowing both ways over a lossy path
+// while both peers update their keys many times.
+func TestKeyUpdate(t *testing.T) {
+	defer func(n wire.PacketNumber) { keyUpdatePackets = n }(keyUpdatePackets)
+	keyUpdatePackets = 20
+
+	srv, srvLoss := newTestMux(t, Config{Listen: true})
+	cli, cliLoss := newTestMux(t, Config{})
+	c, sc := dialTestMux(t, cli, srv)
+	cliLoss.every.Store(10)
+	srvLoss.every.Store(7)
+
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+	writeAll(t, data, c.stream, sc.stream)
+	readFull(t, sc.stream, data)
+	readFull(t, c.stream, data)
+
+	for _, c := range []*Conn{c, sc} {
+		c.mu.Lock()
+		updates := c.keyUpdates
+		c.mu.Unlock()
+		if updates < 5 {
+			t.Errorf("keys updated %d times, want at least %d", updates, 5)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package quic
+
+import (
+	"sync"
+	"time"
+)
+
+// A deadline tells the operations blocked on it when their deadline passes, by
+// closing a channel.
+type deadline struct {
+	mu    sync.Mutex
+	c     chan struct{} // closed once the deadline passed
+	timer *time.Timer   // closes c, nil if no deadline is set
+	gen   int           // bumped by set, so that a stale timer doesn't close c
+}
+
+func newDeadline() *deadline {
+	return &deadline{c: make(chan struct{})}
+}
+
+// set sets the deadline to t. A zero t means no deadline. Operations blocked
+// on an earlier deadline that hasn't passed keep waiting for the new one.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.gen++
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if d.expiredLocked() {
+		d.c = make(chan struct{})
+	}
+
+	if t.IsZero() {
+		return
+	}
+	dur := time.Until(t)
+	if dur <= 0 {
+		close(d.c)
+		return
+	}
+	gen, c := d.gen, d.c
+	d.timer = time.AfterFunc(dur, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		if d.gen == gen {
+			close(c)
+		}
+	})
+}
+
+// done returns a channel that is closed once the deadline passed.
+func (d *deadline) done() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.c
+}
+
+// expired reports whether the deadline passed.
+func (d *deadline) expired() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.expiredLocked()
+}
+
+func (d *deadline) expiredLocked() bool {
+	select {
+	case <-d.c:
+		return true
+	default:
+		return false
+	}
+}
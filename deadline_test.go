@@ -0,0 +1,104 @@
+package quic
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDeadline(t *testing.T) {
+	d := newDeadline()
+	if d.expired() {
+		t.Fatalf("expired with no deadline set")
+	}
+
+	d.set(time.Now().Add(50 * time.Millisecond))
+	done := d.done()
+	if d.expired() {
+		t.Fatalf("expired before the deadline")
+	}
+
+	// Moving the deadline later keeps the waiters waiting.
+	d.set(time.Now().Add(100 * time.Millisecond))
+	select {
+	case <-done:
+		t.Fatalf("expired at the deadline that was moved")
+	case <-time.After(75 * time.Millisecond):
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("not expired after the deadline")
+	}
+
+	// A zero deadline clears the expiry, and one in the past expires
+	// right away.
+	d.set(time.Time{})
+	if d.expired() {
+		t.Fatalf("expired after clearing the deadline")
+	}
+	d.set(time.Now().Add(-time.Second))
+	if !d.expired() {
+		t.Fatalf("not expired with a deadline in the past")
+	}
+}
+
+// checkDeadlineWakes checks that op, blocked, returns a timeout error once
+// setDeadline moves the deadline close.
+func checkDeadlineWakes(t *testing.T, op func() error, setDeadline func(time.Time) error) {
+	t.Helper()
+
+	errc := make(chan error, 1)
+	go func() { errc <- op() }()
+	select {
+	case err := <-errc:
+		t.Fatalf("returned %v before the deadline", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	setDeadline(time.Now().Add(50 * time.Millisecond))
+	select {
+	case err := <-errc:
+		var netErr net.Error
+		if !errors.Is(err, os.ErrDeadlineExceeded) || !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Fatalf("err = %v, want a timeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("still blocked after the deadline")
+	}
+	setDeadline(time.Time{})
+}
+
+func TestConnDeadlines(t *testing.T) {
+	srv, _ := newTestMux(t, Config{Listen: true, StreamReceiveWindow: 1000})
+	cli, cliLoss := newTestMux(t, Config{})
+	c, sc := dialTestMux(t, cli, srv)
+
+	// Nothing to read.
+	checkDeadlineWakes(t, func() error {
+		_, err := sc.Read(make([]byte, 1))
+		return err
+	}, sc.SetReadDeadline)
+	checkDeadlineWakes(t, func() error {
+		_, err := sc.ReadMsg(make([]byte, 1))
+		return err
+	}, sc.SetReadDeadline)
+
+	// The peer's receive window is full.
+	checkDeadlineWakes(t, func() error {
+		_, err := c.Write(make([]byte, 10000))
+		return err
+	}, c.SetWriteDeadline)
+
+	// The previous message can't be sent, as nothing gets acked.
+	cliLoss.every.Store(1)
+	if _, err := c.WriteMsg(make([]byte, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	checkDeadlineWakes(t, func() error {
+		_, err := c.WriteMsg([]byte("hello"))
+		return err
+	}, c.SetWriteDeadline)
+}
@@ -69,7 +69,7 @@ func main() {
 
 	log.Print("muxing on ", ln.LocalAddrPort())
 
-	c, err := transportutil.DialContext(context.Background(), ln, address, serverPubKey)
+	c, err := transportutil.DialContext(context.Background(), ln, address, serverPubKey, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,83 @@
+package quic
+
+import (
+	"github.com/nanokatze/quic-at-home/internal/udp"
+	"github.com/nanokatze/quic-at-home/internal/wire"
+)
+
+// ecnTestingPackets is how many packets are marked ECT(0) on a new path before
+// marking stops until the marks are validated, see RFC 9000, Section 13.4.2.
+const ecnTestingPackets = 10
+
+type ecnState int
+
+const (
+	ecnTesting ecnState = iota
+	ecnUnknown          // waiting for the packets marked while testing to be acked
+	ecnCapable
+	ecnFailed
+)
+
+// ecnValidator checks that the path and the peer support ECN, so that packets
+// are only marked ECT(0) if the marks are delivered, and the peer reports CE
+// marks back. Some networks bleach the marks, or drop marked packets.
+type ecnValidator struct {
+	state  ecnState
+	marked int // packets marked while testing
+	lost   int // of those
+
+	// Largest counts the peer reported so far.
+	peerCounts wire.ECNCounts
+}
+
+// codepoint returns the ECN codepoint to mark the packets sent next with.
+func (v *ecnValidator) codepoint() udp.ECN {
+	if v.state == ecnTesting || v.state == ecnCapable {
+		return udp.ECT0
+	}
+	return udp.NotECT
+}
+
+// sent is called when an ack-eliciting packet was sent marked ECT(0).
+func (v *ecnValidator) sent() {
+	if v.state != ecnTesting {
+		return
+	}
+	v.marked++
+	if v.marked >= ecnTestingPackets {
+		v.state = ecnUnknown
+	}
+}
+
+// lose is called when an ack-eliciting packet marked ECT(0) was declared lost.
+// If all the packets marked while testing get lost, the path likely drops
+// marked packets.
+func (v *ecnValidator) lose() {
+	if v.state != ecnTesting && v.state != ecnUnknown {
+		return
+	}
+	v.lost++
+	if v.lost >= ecnTestingPackets {
+		v.state = ecnFailed
+	}
+}
+
+// ack validates counts, reported in an ACK that newly acked newlyMarked
+// packets marked ECT(0), and reports whether the peer reported new CE marks.
+func (v *ecnValidator) ack(counts wire.ECNCounts, newlyMarked int) (congestion bool) {
+	if v.state == ecnFailed || newlyMarked == 0 {
+		return false
+	}
+
+	// Each of the packets was either delivered as it was sent, or marked
+	// CE. ECT(1) is never sent, so it can't be received either.
+	if counts.ECT0-v.peerCounts.ECT0+counts.CE-v.peerCounts.CE < int64(newlyMarked) || counts.ECT1 > v.peerCounts.ECT1 {
+		v.state = ecnFailed
+		return false
+	}
+
+	congestion = counts.CE > v.peerCounts.CE
+	v.peerCounts = counts
+	v.state = ecnCapable
+	return congestion
+}
@@ -0,0 +1,95 @@
+package quic
+
+import (
+	"testing"
+
+	"github.com/nanokatze/quic-at-home/internal/udp"
+	"github.com/nanokatze/quic-at-home/internal/wire"
+)
+
+type ecnStep struct {
+	sent, lost  int // marked packets
+	counts      wire.ECNCounts
+	newlyMarked int // acked with counts, if not zero
+
+	state      ecnState // after the step
+	congestion bool
+}
+
+var ecnValidatorTests = []struct {
+	name  string
+	steps []ecnStep
+}{
+	{
+		name: "capable",
+		steps: []ecnStep{
+			{sent: 2, state: ecnTesting},
+			{counts: wire.ECNCounts{ECT0: 2}, newlyMarked: 2, state: ecnCapable},
+			{sent: 20, state: ecnCapable},
+			{counts: wire.ECNCounts{ECT0: 20, CE: 1}, newlyMarked: 19, state: ecnCapable, congestion: true},
+			{counts: wire.ECNCounts{ECT0: 21, CE: 1}, newlyMarked: 1, state: ecnCapable}, // no new CE marks
+		},
+	},
+	{
+		name: "unknown",
+		steps: []ecnStep{
+			{sent: ecnTestingPackets, state: ecnUnknown},
+			{lost: ecnTestingPackets - 1, state: ecnUnknown},
+			{counts: wire.ECNCounts{ECT0: 1}, newlyMarked: 1, state: ecnCapable},
+		},
+	},
+	{
+		name: "bleached",
+		steps: []ecnStep{
+			{sent: 2, state: ecnTesting},
+			{newlyMarked: 2, state: ecnFailed},
+		},
+	},
+	{
+		name: "undercounted",
+		steps: []ecnStep{
+			{sent: 3, state: ecnTesting},
+			{counts: wire.ECNCounts{ECT0: 1, CE: 1}, newlyMarked: 3, state: ecnFailed},
+		},
+	},
+	{
+		name: "remarked",
+		steps: []ecnStep{
+			{sent: 2, state: ecnTesting},
+			{counts: wire.ECNCounts{ECT0: 2, ECT1: 1}, newlyMarked: 2, state: ecnFailed},
+		},
+	},
+	{
+		name: "dropped",
+		steps: []ecnStep{
+			{sent: ecnTestingPackets, lost: ecnTestingPackets, state: ecnFailed},
+		},
+	},
+}
+
+func TestECNValidator(t *testing.T) {
+	for _, test := range ecnValidatorTests {
+		t.Run(test.name, func(t *testing.T) {
+			var v ecnValidator
+			for i, step := range test.steps {
+				for j := 0; j < step.sent; j++ {
+					v.sent()
+				}
+				for j := 0; j < step.lost; j++ {
+					v.lose()
+				}
+				congestion := false
+				if step.newlyMarked > 0 {
+					congestion = v.ack(step.counts, step.newlyMarked)
+				}
+				if v.state != step.state || congestion != step.congestion {
+					t.Fatalf("%d: state = %d, congestion = %v, want %d, %v", i, v.state, congestion, step.state, step.congestion)
+				}
+			}
+
+			if v.state == ecnFailed && v.codepoint() != udp.NotECT {
+				t.Fatalf("codepoint = %02b after failing, want %02b", v.codepoint(), udp.NotECT)
+			}
+		})
+	}
+}
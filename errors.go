@@ -0,0 +1,116 @@
+package quic
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nanokatze/quic-at-home/internal/wire"
+)
+
+// ApplicationError is the error a connection was closed with by the
+// application, see Conn.CloseWithError.
+type ApplicationError struct {
+	Code   uint64
+	Reason string
+	Remote bool // the error was reported by the peer
+}
+
+func (e *ApplicationError) Error() string {
+	s := fmt.Sprintf("application error %d", e.Code)
+	if e.Remote {
+		s = "remote " + s
+	}
+	if e.Reason != "" {
+		s += ": " + e.Reason
+	}
+	return s
+}
+
+// RejectedError is returned by DialContextAddrPort if the peer rejected the
+// connection, see Config.Authorize.
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	s := "connection rejected"
+	if e.Reason != "" {
+		s += ": " + e.Reason
+	}
+	return s
+}
+
+// ErrNoCommonProtocol is the reason a connection is rejected or fails to be
+// established with when the peers have no application protocol in common, see
+// Config.Protocols.
+var ErrNoCommonProtocol = errors.New("no common application protocol")
+
+// ErrCipherSuiteMismatch is returned by DialContextAddrPort if the peer uses a
+// different cipher suite, see Config.CipherSuite.
+var ErrCipherSuiteMismatch = errors.New("cipher suite mismatch")
+
+// TransportErrorCode is a code of an error detected by the transport.
+type TransportErrorCode uint64
+
+const (
+	NoError TransportErrorCode = iota
+	InternalError
+	ProtocolViolation
+	FlowControlError
+	StreamLimitError
+	FinalSizeError
+	FrameEncodingError
+)
+
+func (code TransportErrorCode) String() string {
+	switch code {
+	case NoError:
+		return "no error"
+	case InternalError:
+		return "internal error"
+	case ProtocolViolation:
+		return "protocol violation"
+	case FlowControlError:
+		return "flow control error"
+	case StreamLimitError:
+		return "stream limit error"
+	case FinalSizeError:
+		return "final size error"
+	case FrameEncodingError:
+		return "frame encoding error"
+	}
+	return fmt.Sprintf("transport error %d", uint64(code))
+}
+
+// TransportError is the error a connection was closed with because of a
+// failure detected by the transport, on either side.
+type TransportError struct {
+	Code   TransportErrorCode
+	Reason string
+	Remote bool // the error was detected by the peer
+}
+
+func transportErrorf(code TransportErrorCode, format string, a ...any) *TransportError {
+	return &TransportError{
+		Code:   code,
+		Reason: fmt.Sprintf(format, a...),
+	}
+}
+
+func (e *TransportError) Error() string {
+	s := e.Code.String()
+	if e.Remote {
+		s = "remote " + s
+	}
+	if e.Reason != "" {
+		s += ": " + e.Reason
+	}
+	return s
+}
+
+func (e *TransportError) closeFrame() *wire.Close {
+	return &wire.Close{
+		Code:   int64(e.Code),
+		Reason: []byte(e.Reason),
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/nanokatze/quic-at-home
 
-go 1.19
+go 1.24
 
 require (
 	golang.org/x/crypto v0.0.0-20220411220226-7b82a4e95df4
@@ -2,13 +2,80 @@ package quic
 
 import (
 	"bytes"
+	"errors"
 	"net/netip"
 	"sync"
+	"time"
 
 	"github.com/nanokatze/quic-at-home/internal/sec"
+	"github.com/nanokatze/quic-at-home/internal/udp"
 	"github.com/nanokatze/quic-at-home/internal/wire"
 )
 
+// Sizes of the Noise handshake messages sans payload.
+const (
+	initiatorMessageOverhead = 32 + (32 + 16) + 16 // IK's e, s and the payload tag
+	responderMessageOverhead = 32 + 16             // IK's e and the payload tag
+
+	hybridInitiatorMessageOverhead = initiatorMessageOverhead + (1088 + 16) // and IKhybrid's skem
+
+	xxInitiationMessageOverhead = 32                  // XX's e
+	xxResponderMessageOverhead  = 32 + (32 + 16) + 16 // XX's e, s and the payload tag
+	xxCompletionMessageOverhead = (32 + 16) + 16      // XX's s and the payload tag
+)
+
+// The byte following the cipher suite in a handshake packet tells which
+// handshake message the packet carries.
+const (
+	ikInitiation     = 0x00 // the first and only initiator's message of IK
+	xxInitiation     = 0x01 // the first message of XX
+	xxCompletion     = 0x02 // the third message of XX
+	ikpsk2Initiation = 0x03 // the first and only initiator's message of IKpsk2
+
+	// The initiator's message of IKhybrid doesn't fit in a single packet,
+	// so it is split in halves.
+	ikHybridInitiationFirst  = 0x04
+	ikHybridInitiationSecond = 0x05
+)
+
+// In XX, the responder learns the initiator's identity from the last handshake
+// message, thus it can only respond after the handshake is complete. The
+// response is sealed with the responder's transport key, with a nonce that the
+// packet numbers never reach and that is not the one reserved for rekeying.
+const handshakeResponseNonce = 1<<64 - 2
+
+// The first byte of the responder's handshake payload tells whether the
+// responder accepted the connection. An acceptance is followed by the
+// responder's transport parameters, and a rejection by a length-prefixed
+// reason.
+const (
+	handshakeAccepted = 0x00
+	handshakeRejected = 0x01
+)
+
+// MaxHandshakePayloadLen bounds the length of the application payloads carried
+// by the handshake messages, see Mux.DialContextAddrPort and
+// Config.ResponsePayload.
+const MaxHandshakePayloadLen = 768
+
+// maxRejectionReasonLen bounds the length of the reason sent in a rejection.
+const maxRejectionReasonLen = 256
+
+// maxPendingHandshakes bounds how many XX handshakes the responder waits to be
+// completed, and, separately, how many IKhybrid initiators' messages it waits
+// to receive the second half of.
+const maxPendingHandshakes = 1024
+
+// pendingHandshakeTimeout is how long the responder keeps the state of a
+// handshake awaiting the initiator's next message: a few PTOs at the initial
+// RTT estimate, see rttFilter.PTO.
+const pendingHandshakeTimeout = 3 * time.Second
+
+// maxPendingHandshakesPerAddr bounds how many of the pending handshakes can be
+// with initiators at one IP address, so that a single initiator can't use up
+// the room for everyone else's.
+const maxPendingHandshakesPerAddr = 16
+
 type handshaker struct {
 	mux *Mux
 	id  wire.ConnID
@@ -19,16 +86,25 @@ type handshaker struct {
 
 	in chan []byte
 
-	raddr netip.AddrPort
+	raddr   netip.AddrPort
+	pattern sec.Pattern
+
+	payload []byte
+
+	// Valid once handshake succeeds
+	peerParams  wire.TransportParameters
+	peerPayload []byte
 }
 
-func newHandshaker(mux *Mux, cid wire.ConnID, raddr netip.AddrPort) *handshaker {
+func newHandshaker(mux *Mux, cid wire.ConnID, raddr netip.AddrPort, pattern sec.Pattern, payload []byte) *handshaker {
 	return &handshaker{
-		mux:    mux,
-		id:     cid,
-		closed: make(chan struct{}),
-		in:     make(chan []byte, 1),
-		raddr:  raddr,
+		mux:     mux,
+		id:      cid,
+		closed:  make(chan struct{}),
+		in:      make(chan []byte, 1),
+		raddr:   raddr,
+		pattern: pattern,
+		payload: payload,
 	}
 }
 
@@ -41,60 +117,187 @@ func (c *handshaker) handshake(hs sec.Handshake) error {
 }
 
 func (c *handshaker) handshakeImpl(hs sec.Handshake) error {
-	{
-		buf := make([]byte, maxPacketSize)
-		copy(buf, c.id[:])
-		buf[0] |= wire.HandshakePacket
-
-		w := wire.NewWriter(buf[8:])
-		cookie, _ := c.mux.jar.Load(c.raddr)
-		if err := wire.EncodeLengthPrefixedBytes(w, cookie); err != nil {
-			return err
+	params := c.mux.config.transportParameters()
+
+	switch c.pattern {
+	case sec.PatternIK, sec.PatternIKpsk2, sec.PatternIKhybrid:
+		// The initiator's payload is prefixed with a timestamp, which
+		// allows the responder to detect replays.
+		timestamp := c.mux.timestamp()
+		msg := append(timestamp[:], encodeHandshakePayload(params, c.payload)...)
+
+		switch c.pattern {
+		case sec.PatternIK:
+			if err := c.writeMessage(hs, ikInitiation, msg); err != nil {
+				return err
+			}
+
+		case sec.PatternIKpsk2:
+			if err := c.writeMessage(hs, ikpsk2Initiation, msg); err != nil {
+				return err
+			}
+
+		case sec.PatternIKhybrid:
+			var buf bytes.Buffer
+			if err := hs.WriteMessage(&buf, msg); err != nil {
+				return err
+			}
+			data := buf.Bytes()
+			if err := c.writePacket(ikHybridInitiationFirst, data[:len(data)/2]); err != nil {
+				return err
+			}
+			if err := c.writePacket(ikHybridInitiationSecond, data[len(data)/2:]); err != nil {
+				return err
+			}
 		}
-		var tmp bytes.Buffer
-		if err := hs.WriteMessage(&tmp, nil); err != nil {
+
+		p, err := c.receive()
+		if err != nil {
 			return err
 		}
-		if err := wire.EncodeLengthPrefixedBytes(w, tmp.Bytes()); err != nil {
+		r := wire.NewReader(p[8:])
+		if r.Remaining() < responderMessageOverhead {
+			return errors.New("handshake response too short")
+		}
+		payload, err := hs.ReadMessage(r, uint16(r.Remaining()-responderMessageOverhead))
+		if err != nil {
 			return err
 		}
+		return c.handleResponse(payload)
 
-		c.mux.pconn.WriteToUDPAddrPort(buf, c.raddr)
-	}
-
-	{
-		var p []byte
-		select {
-		case p = <-c.in:
-		case <-c.closed:
-			return c.closeErr
+	case sec.PatternXX:
+		if err := c.writeMessage(hs, xxInitiation, nil); err != nil {
+			return err
 		}
 
+		p, err := c.receive()
+		if err != nil {
+			return err
+		}
 		r := wire.NewReader(p[8:])
+		if r.Remaining() < xxResponderMessageOverhead {
+			return errors.New("handshake response too short")
+		}
+		if _, err := hs.ReadMessage(r, uint16(r.Remaining()-xxResponderMessageOverhead)); err != nil {
+			return err
+		}
+		if err := c.mux.config.VerifyPeer(hs.RemoteStaticPublicKey()); err != nil {
+			return err
+		}
 
-		// Mux.handlePacket ensured that len(p) ≥ 8
-		switch p[0] & 0xc0 {
-		case wire.RetryPacket:
-			// BUG: c.mux.jar may grow indefinitely, but this is likely to
-			// not be a problem: we expect Mux to connect to few addresses
-			// in its lifetime.
-			c.mux.jar.Store(c.raddr, slices_Clone(p[8:]))
-			return ErrAgain
-
-		case wire.DataPacket:
-			if _, err := hs.ReadMessage(r, 0); err != nil {
-				return err
-			}
+		// Unlike in IK, the initiator's payload can't be replayed: the
+		// last message depends on the responder's ephemeral key.
+		if err := c.writeMessage(hs, xxCompletion, encodeHandshakePayload(params, c.payload)); err != nil {
+			return err
+		}
 
-		default:
-			panic("unreachable")
+		p, err = c.receive()
+		if err != nil {
+			return err
+		}
+		_, c2, _ := hs.Split()
+		payload, err := c2.Open(nil, handshakeResponseNonce, p[8:], p[0:8])
+		if err != nil {
+			return err
 		}
+		return c.handleResponse(payload)
+	}
+
+	panic("unreachable")
+}
+
+// writeMessage sends a handshake packet carrying the next message of hs.
+func (c *handshaker) writeMessage(hs sec.Handshake, kind byte, payload []byte) error {
+	var buf bytes.Buffer
+	if err := hs.WriteMessage(&buf, payload); err != nil {
+		return err
+	}
+	return c.writePacket(kind, buf.Bytes())
+}
+
+// writePacket sends a handshake packet carrying data.
+func (c *handshaker) writePacket(kind byte, data []byte) error {
+	buf := make([]byte, minPacketSize)
+	copy(buf, c.id[:])
+	buf[0] |= wire.HandshakePacket
+
+	w := wire.NewWriter(buf[8:])
+	if err := w.WriteByte(byte(c.mux.config.CipherSuite)); err != nil {
+		return err
+	}
+	if err := w.WriteByte(kind); err != nil {
+		return err
+	}
+	cookie, _ := c.mux.jar.Load(c.raddr)
+	if err := wire.EncodeLengthPrefixedBytes(w, cookie); err != nil {
+		return err
+	}
+	if err := wire.EncodeLengthPrefixedBytes(w, data); err != nil {
+		return err
 	}
 
+	c.mux.pconn.WriteToUDPAddrPort(buf, c.raddr)
 	return nil
 }
 
-func (c *handshaker) handlePacket(p []byte, raddr netip.AddrPort) {
+// receive waits for the responder's next message.
+func (c *handshaker) receive() ([]byte, error) {
+	var p []byte
+	select {
+	case p = <-c.in:
+	case <-c.closed:
+		return nil, c.closeErr
+	}
+
+	// Mux.handlePacket ensured that len(p) ≥ 8
+	switch p[0] & 0xc0 {
+	case wire.RetryPacket:
+		// BUG: c.mux.jar may grow indefinitely, but this is likely to
+		// not be a problem: we expect Mux to connect to few addresses
+		// in its lifetime.
+		c.mux.jar.Store(c.raddr, slices_Clone(p[8:]))
+		return nil, ErrAgain
+
+	case wire.NegotiationPacket:
+		// The negotiation packet is not authenticated, but neither
+		// is the retry packet: an attacker able to send either can
+		// prevent the connection anyway.
+		return nil, ErrCipherSuiteMismatch
+
+	case wire.DataPacket:
+		return p, nil
+	}
+
+	panic("unreachable")
+}
+
+// handleResponse handles the responder's decision on the connection.
+func (c *handshaker) handleResponse(payload []byte) error {
+	r := wire.NewReader(payload)
+	status, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch status {
+	case handshakeAccepted:
+		c.peerParams, c.peerPayload, err = decodeHandshakePayload(r)
+		if err != nil {
+			return err
+		}
+		return checkSelectedProtocol(c.mux.config.Protocols, c.peerParams.Protocols)
+
+	case handshakeRejected:
+		reason, err := wire.DecodeLengthPrefixedBytes(r)
+		if err != nil {
+			return err
+		}
+		return &RejectedError{Reason: string(reason)}
+	}
+
+	return errors.New("bad handshake response")
+}
+
+func (c *handshaker) handlePacket(p []byte, raddr netip.AddrPort, ecn udp.ECN) {
 	select {
 	case c.in <- slices_Clone(p):
 	default:
@@ -108,3 +311,116 @@ func (c *handshaker) closeWithError(err error) {
 		close(c.closed)
 	})
 }
+
+// encodeHandshakePayload returns the handshake payload to send to the peer: the
+// length-prefixed transport parameters, followed by the application payload.
+func encodeHandshakePayload(params wire.TransportParameters, payload []byte) []byte {
+	paramsBuf := make([]byte, minPacketSize)
+	pw := wire.NewWriter(paramsBuf)
+	if err := params.Encode(pw); err != nil {
+		panic(err)
+	}
+
+	buf := make([]byte, 2+pw.Len()+len(payload))
+	w := wire.NewWriter(buf)
+	if err := wire.EncodeLengthPrefixedBytes(w, paramsBuf[:pw.Len()]); err != nil {
+		panic(err)
+	}
+	if _, err := w.Write(payload); err != nil {
+		panic(err)
+	}
+	return buf[:w.Len()]
+}
+
+func decodeHandshakePayload(r *wire.Reader) (wire.TransportParameters, []byte, error) {
+	params, err := wire.DecodeLengthPrefixedBytes(r)
+	if err != nil {
+		return wire.TransportParameters{}, nil, err
+	}
+	peerParams, err := wire.DecodeTransportParameters(wire.NewReader(params))
+	if err != nil {
+		return wire.TransportParameters{}, nil, err
+	}
+	if err := validateTransportParameters(peerParams); err != nil {
+		return wire.TransportParameters{}, nil, err
+	}
+	return peerParams, slices_Clone(r.Next(r.Remaining())), nil
+}
+
+// A handshakeSealer seals the responder's handshake response to w.
+type handshakeSealer func(w *wire.Writer, payload []byte) error
+
+// ikSealer seals the response as the second message of the IK handshake hs.
+func ikSealer(hs sec.Handshake) handshakeSealer {
+	return func(w *wire.Writer, payload []byte) error {
+		return hs.WriteMessage(w, payload)
+	}
+}
+
+// xxSealer seals the response with the responder's transport key of the
+// completed XX handshake hs, see handshakeResponseNonce.
+func xxSealer(hs sec.Handshake, cid wire.ConnID) handshakeSealer {
+	return func(w *wire.Writer, payload []byte) error {
+		_, c2, _ := hs.Split()
+		_, err := w.Write(c2.Seal(nil, handshakeResponseNonce, payload, cid[:]))
+		return err
+	}
+}
+
+// rejectHandshake responds to the initiator with an authenticated rejection.
+func (m *Mux) rejectHandshake(seal handshakeSealer, cid wire.ConnID, raddr netip.AddrPort, reason string) {
+	reason = truncateUTF8(reason, maxRejectionReasonLen)
+
+	payload := make([]byte, 1+wire.VarintLen(int64(len(reason)))+len(reason))
+	payload[0] = handshakeRejected
+	if err := wire.EncodeLengthPrefixedBytes(wire.NewWriter(payload[1:]), []byte(reason)); err != nil {
+		panic(err)
+	}
+
+	buf := make([]byte, minPacketSize)
+	copy(buf, cid[:])
+	buf[0] |= wire.DataPacket
+
+	w := wire.NewWriter(buf[8:])
+	if err := seal(w, payload); err != nil {
+		return
+	}
+
+	m.pconn.WriteToUDPAddrPort(buf[:8+w.Len()], raddr)
+}
+
+// selectProtocol returns the first of the local protocols that the peer
+// offered. If there are no local protocols, selectProtocol selects none.
+func selectProtocol(local, offered []string) (string, error) {
+	if len(local) == 0 {
+		return "", nil
+	}
+	for _, protocol := range local {
+		for _, o := range offered {
+			if protocol == o {
+				return protocol, nil
+			}
+		}
+	}
+	return "", ErrNoCommonProtocol
+}
+
+// checkSelectedProtocol checks that the peer selected one of the local
+// protocols, or none if there are no local protocols.
+func checkSelectedProtocol(local, selected []string) error {
+	switch len(selected) {
+	case 0:
+		if len(local) > 0 {
+			return ErrNoCommonProtocol
+		}
+		return nil
+
+	case 1:
+		for _, protocol := range local {
+			if protocol == selected[0] {
+				return nil
+			}
+		}
+	}
+	return errors.New("peer selected a protocol that was not offered")
+}
@@ -2,46 +2,81 @@ package quic
 
 import (
 	"encoding/binary"
-	"errors"
-	"fmt"
 	"io"
+	"math"
 	"net/netip"
 	"time"
 
+	"github.com/nanokatze/quic-at-home/internal/udp"
 	"github.com/nanokatze/quic-at-home/internal/wire"
 )
 
-func (c *Conn) handlePacket(p []byte, raddr netip.AddrPort) {
+func (c *Conn) handlePacket(p []byte, raddr netip.AddrPort, ecn udp.ECN) {
 	if p[0]&0xc0 != wire.DataPacket {
 		return
 	}
-	if len(p) < 12 {
+	if len(p) < 12+wire.HeaderSampleSize {
 		return
 	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.handlePacketImpl(p, raddr, time.Now()); err != nil {
-		if err != io.ErrClosedPipe {
-			err = fmt.Errorf("protocol botch: %v", err)
+	if err := c.handlePacketImpl(p, raddr, ecn, time.Now()); err != nil {
+		// Tell the peer about failures we detected. Errors reported by
+		// the peer need no reply.
+		var frame *wire.Close
+		if err, ok := err.(*TransportError); ok && !err.Remote {
+			frame = err.closeFrame()
 		}
 		c.mu.Unlock()
-		c.closeWithError(err)
+		c.closeWithError(err, frame)
 		c.mu.Lock()
 	}
 }
 
-func (c *Conn) handlePacketImpl(p []byte, raddr netip.AddrPort, now time.Time) error {
+func (c *Conn) handlePacketImpl(p []byte, raddr netip.AddrPort, ecn udp.ECN, now time.Time) error {
+	protectHeader(c.recvHP, p)
+
 	maxRcvdPN := c.maxRcvdPNRanges.Max()
 
 	pn := guessPacketNumber(maxRcvdPN, binary.LittleEndian.Uint32(p[8:12]))
 
-	payload, err := c.recvAEAD.Open(p[12:12], uint64(pn), p[12:], p[0:8])
+	aead := c.recvAEAD
+	keyPhase := p[0]&wire.KeyPhase != 0
+	keyUpdate := false
+	if keyPhase != c.recvKeyPhase {
+		if pn < c.recvKeyPhaseStartPN {
+			// A packet sent before the last key update.
+			if c.prevRecvAEAD == nil || now.After(c.prevRecvAEADExpiry) {
+				c.prevRecvAEAD = nil
+				return nil
+			}
+			aead = c.prevRecvAEAD
+		} else {
+			aead = c.nextRecvAEAD
+			keyUpdate = true
+		}
+	}
+
+	payload, err := aead.Open(p[12:12], uint64(pn), p[12:], p[0:8])
 	if err != nil {
 		return nil
 	}
 
+	if keyUpdate {
+		// Keep the previous keys around for a while, for packets that
+		// got reordered with the first packets sent with the new keys.
+		c.prevRecvAEAD = c.recvAEAD
+		c.prevRecvAEADExpiry = now.Add(3 * c.rttFilter.PTO())
+		c.recvAEAD = c.nextRecvAEAD
+		c.nextRecvAEAD = c.recvAEAD.Rekey()
+		c.recvKeyPhase = keyPhase
+		c.recvKeyPhaseStartPN = pn
+	}
+
+	c.lastRcvTime = now
+
 	ackEliciting := false
 	for r := wire.NewReader(payload); r.Remaining() > 0; {
 		t := r.PeekByte()
@@ -53,13 +88,14 @@ func (c *Conn) handlePacketImpl(p []byte, raddr netip.AddrPort, now time.Time) e
 		case wire.IsPing(t):
 			_, err := wire.DecodePing(r)
 			if err != nil {
-				return fmt.Errorf("decode PING: %v", err)
+				return transportErrorf(FrameEncodingError, "decode PING: %v", err)
 			}
 
 		case wire.IsAck(t):
-			ack, err := wire.DecodeAck(r, maxAckedPacketNumberRangeCount)
+			// The ranges are bounded by the packet size.
+			ack, err := wire.DecodeAck(r, math.MaxInt)
 			if err != nil {
-				return fmt.Errorf("decode ACK: %v", err)
+				return transportErrorf(FrameEncodingError, "decode ACK: %v", err)
 			}
 
 			if err := c.handleAck(ack, raddr, now); err != nil {
@@ -69,52 +105,78 @@ func (c *Conn) handlePacketImpl(p []byte, raddr netip.AddrPort, now time.Time) e
 		case wire.IsStream(t):
 			s, err := wire.DecodeStream(r)
 			if err != nil {
-				return fmt.Errorf("decode STREAM: %v", err)
+				return transportErrorf(FrameEncodingError, "decode STREAM: %v", err)
 			}
 
 			if err := c.handleStream(s); err != nil {
 				return err
 			}
 
+		case wire.IsMaxStreams(t):
+			m, err := wire.DecodeMaxStreams(r)
+			if err != nil {
+				return transportErrorf(FrameEncodingError, "decode MAX_STREAMS: %v", err)
+			}
+
+			c.handleMaxStreams(m)
+
 		case wire.IsMaxStreamData(t):
-			off, err := wire.DecodeMaxStreamData(r)
+			m, err := wire.DecodeMaxStreamData(r)
 			if err != nil {
-				return fmt.Errorf("decode MAX_STREAM_DATA: %v", err)
+				return transportErrorf(FrameEncodingError, "decode MAX_STREAM_DATA: %v", err)
 			}
 
-			c.handleMaxStreamData(off)
+			if err := c.handleMaxStreamData(m); err != nil {
+				return err
+			}
 
 		case wire.IsMsg(t):
 			m, err := wire.DecodeMsg(r)
 			if err != nil {
-				return fmt.Errorf("decode MSG: %v", err)
+				return transportErrorf(FrameEncodingError, "decode MSG: %v", err)
 			}
 
 			c.handleMsg(m)
 
 		case wire.IsClose(t):
-			return io.ErrClosedPipe
+			f, err := wire.DecodeClose(r)
+			if err != nil {
+				return transportErrorf(FrameEncodingError, "decode CLOSE: %v", err)
+			}
+
+			return closeErrorFromFrame(f)
 
 		default:
-			return fmt.Errorf("unknown frame 0x%02x", t)
+			return transportErrorf(FrameEncodingError, "unknown frame 0x%02x", t)
 		}
 
-		if maxRcvdPN < pn && (t != 0b00000000 && !wire.IsAck(t)) { // TODO: move this into wire.IsAckEliciting
+		if t != 0b00000000 && !wire.IsAck(t) { // TODO: move this into wire.IsAckEliciting
 			ackEliciting = true
 		}
 	}
 
 	if maxRcvdPN < pn {
-		// TODO: make this not ugly
-		if len(c.maxRcvdPNRanges) == 0 || c.maxRcvdPNRanges[0].Max+1 < pn {
-			c.maxRcvdPNRanges = append(wire.PacketNumberRanges{{pn, pn}}, c.maxRcvdPNRanges...)
-		} else if c.maxRcvdPNRanges[0].Max+1 == pn {
-			c.maxRcvdPNRanges[0].Max = pn
-		}
+		c.maxRcvdPNRcvTime = now
+	}
+
+	// Reordered packets are recorded too, in case they arrive before the
+	// ACK reporting them missing is sent. Duplicates aren't counted again.
+	reordered := false // a reordered packet filled a gap
+	if !c.maxRcvdPNRanges.Contains(pn) {
+		reordered = pn < maxRcvdPN
+		c.maxRcvdPNRanges = c.maxRcvdPNRanges.Insert(pn)
 		if len(c.maxRcvdPNRanges) > maxRcvdPacketNumberRangeCount {
 			c.maxRcvdPNRanges = c.maxRcvdPNRanges[:maxRcvdPacketNumberRangeCount]
 		}
-		c.maxRcvdPNRcvTime = now
+
+		switch ecn {
+		case udp.ECT0:
+			c.ecnCounts.ECT0++
+		case udp.ECT1:
+			c.ecnCounts.ECT1++
+		case udp.CE:
+			c.ecnCounts.CE++
+		}
 	}
 
 	switch {
@@ -122,10 +184,19 @@ func (c *Conn) handlePacketImpl(p []byte, raddr netip.AddrPort, now time.Time) e
 		// Likely loss, send ACK ASAP
 		c.sendAckBy = now
 
+	case maxRcvdPN < pn && ecn == udp.CE:
+		// Let the peer react to the congestion ASAP
+		c.sendAckBy = now
+
+	case reordered && ackEliciting:
+		// The peer may be about to declare the packet lost, let it
+		// know otherwise ASAP
+		c.sendAckBy = now
+
 	case maxRcvdPN+1 == pn:
 		if ackEliciting {
 			if c.sendAckBy.IsZero() {
-				c.sendAckBy = now.Add(maxAckDelay - timerGranularity)
+				c.sendAckBy = now.Add(c.maxAckDelay - timerGranularity)
 			} else {
 				// Send ACK immediately every now and then.
 				c.sendAckBy = now
@@ -148,8 +219,19 @@ func (c *Conn) handlePacketImpl(p []byte, raddr netip.AddrPort, now time.Time) e
 
 func (c *Conn) handleAck(ack wire.Ack, raddr netip.AddrPort, now time.Time) error {
 	maxPNAcks := ack.Ranges.Max()
+	// An ACK may leave out its least ranges to fit in the packet, so the
+	// packets below the ones it reports aren't necessarily lost. The ACK
+	// leads a packet of at least minPacketSize: if there was room left for
+	// another range, two varints, and the range count growing by a byte,
+	// none were left out.
+	minPNAcks := ack.Ranges[len(ack.Ranges)-1].Min
+	truncated := wire.AckMaxRangeCount(minPacketSize-12-16-(2*8+1), ack) < len(ack.Ranges)
 	if maxPNAcks >= wire.PacketNumber(c.seq) {
-		return errors.New("optimistic ack")
+		return transportErrorf(ProtocolViolation, "optimistic ack")
+	}
+
+	if maxPNAcks >= c.sendKeyPhaseStartPN {
+		c.sendKeyPhaseAcked = true
 	}
 
 	if p, ok := c.inFlightPackets[maxPNAcks]; ok && c.maxPNAcked < maxPNAcks {
@@ -163,47 +245,90 @@ func (c *Conn) handleAck(ack wire.Ack, raddr netip.AddrPort, now time.Time) erro
 			c.migrationAddr = netip.AddrPort{}
 		}
 
-		c.rttFilter.Update(now.Sub(p.sent), min(ack.Delay, maxAckDelay), now)
+		c.rttFilter.Update(now.Sub(p.sent), min(ack.Delay, c.peerMaxAckDelay), now)
 	}
 
 	ackElicitingPacketsInFlight := false
+	newlyMarked := 0           // newly acked packets marked ECT(0)
+	var maxSentAcked time.Time // when the last newly acked packet was sent
 	for pn, p := range c.inFlightPackets {
 		switch {
 		case ack.Ranges.Contains(pn): // ack
 			c.maxPNAcked = max(c.maxPNAcked, pn)
-			c.maxRcvdPNRanges = c.maxRcvdPNRanges.TrimLesser(p.maxPNAcks)
+			// The peer knows about the ranges the ACK in p
+			// reported, but not about the ones the ACK left out
+			// to fit, nor the packets received since. The
+			// greatest range is kept, as it tells the greatest
+			// packet number received.
+			for _, r := range p.acks {
+				c.maxRcvdPNRanges = c.maxRcvdPNRanges.Remove(r)
+			}
 
 			delete(c.inFlightPackets, pn)
 			c.inFlightBytes -= p.size
 
+			if p.pmtuProbe {
+				c.pmtud.probeAcked(p.size, now)
+				continue
+			}
+
 			c.congestionController.Ack(p.size, p.sent, now)
 
-			c.maxStreamOffAcked = max(c.maxStreamOffAcked, p.maxStreamOff)
+			if p.ecn {
+				newlyMarked++
+			}
+			if maxSentAcked.Before(p.sent) {
+				maxSentAcked = p.sent
+			}
+
+			c.maxPeerStreamsAcked = max(c.maxPeerStreamsAcked, p.maxStreams)
+
+			for _, m := range p.maxStreamData {
+				if s, ok := c.streams[m.ID]; ok {
+					s.maxOffAcked = max(s.maxOffAcked, m.Off)
+				}
+			}
 
 			for _, f := range p.streamFragments {
-				c.streamBytesInFlight -= len(f.data)
+				if s, ok := c.streams[f.id]; ok {
+					s.bytesInFlight -= len(f.data)
+					if f.fin {
+						s.finAcked = true
+					}
+
+					// Unblock the user if they were blocked on the
+					// MaxStreamBytesInFlight limit.
+					select {
+					case s.sndready <- struct{}{}:
+					default:
+					}
+
+					c.maybeRemoveStream(s)
+				}
 			}
 			if len(p.streamFragments) > 0 {
-				// Unblock the user if they were blocked on the
-				// MaxStreamBytesInFlight limit.
 				select {
-				case c.relsndready <- struct{}{}:
+				case c.drainready <- struct{}{}:
 				default:
 				}
 			}
 
-		case pn < maxPNAcks && !noNacks: // nack
+		case pn < maxPNAcks && (minPNAcks < pn || !truncated) && !noNacks: // nack
 			delete(c.inFlightPackets, pn)
 			c.inFlightBytes -= p.size
 
-			c.congestionController.Loss(p.sent, now)
+			if p.pmtuProbe {
+				c.pmtud.probeLost(p.size, now)
+				continue
+			}
 
-			if c.maxStreamOffInFlight == p.maxStreamOff {
-				c.maxStreamOffInFlight = 0
+			c.congestionController.Loss(p.size, p.sent, now)
+			if p.ecn {
+				c.ecn.lose()
 			}
+			c.pmtud.lost(p.size)
 
-			// TODO: keep c.streamFragments sorted
-			c.streamFragments = append(p.streamFragments, c.streamFragments...)
+			c.requeue(p)
 
 			c.bytesNacked += int64(p.size)
 
@@ -212,6 +337,10 @@ func (c *Conn) handleAck(ack wire.Ack, raddr netip.AddrPort, now time.Time) erro
 		}
 	}
 
+	if c.ecn.ack(ack.ECN, newlyMarked) {
+		c.congestionController.Congestion(maxSentAcked, now)
+	}
+
 	if ackElicitingPacketsInFlight {
 		c.timeoutBackoff = 0
 		c.timeout = now.Add(c.rttFilter.PTO() << c.timeoutBackoff)
@@ -220,32 +349,76 @@ func (c *Conn) handleAck(ack wire.Ack, raddr netip.AddrPort, now time.Time) erro
 	return nil
 }
 
-func (c *Conn) handleMaxStreamData(off wire.MaxStreamData) {
-	if c.maxStreamOff < int64(off) {
-		c.maxStreamOff = int64(off)
+func (c *Conn) handleMaxStreams(m wire.MaxStreams) {
+	if c.peerMaxStreams < m.Max {
+		c.peerMaxStreams = m.Max
 
 		// Unblock the user if they were blocked.
 		select {
-		case c.relsndready <- struct{}{}:
+		case c.openready <- struct{}{}:
 		default:
 		}
 	}
 }
 
-func (c *Conn) handleStream(s wire.Stream) error {
-	// It is ok if s.Off+int64(len(s.Data)) > c.maxStreamOffAcked: the peer
-	// could've successfuly received MAX_STREAM_OFFSET, but the packet
-	// acking the MAX_STREAM_OFFSET was lost.
-	if _, err := c.streamReassembler.WriteAt(s.Data, s.Off); err != nil {
+func (c *Conn) handleMaxStreamData(m wire.MaxStreamData) error {
+	s, err := c.streamByID(m.ID)
+	if err != nil {
 		return err
 	}
+	if s == nil {
+		return nil
+	}
+
+	if s.maxOff < m.Off {
+		s.maxOff = m.Off
+
+		// Unblock the user if they were blocked.
+		select {
+		case s.sndready <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (c *Conn) handleStream(f wire.Stream) error {
+	s, err := c.streamByID(f.ID)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return nil
+	}
+
+	end := f.Off + int64(len(f.Data))
+	if s.finOff >= 0 && s.finOff < end {
+		return transportErrorf(FinalSizeError, "STREAM data beyond final size")
+	}
+	if f.Fin {
+		if s.finOff >= 0 && s.finOff != end {
+			return transportErrorf(FinalSizeError, "final size changed")
+		}
+		if end < s.maxRcvdOff {
+			return transportErrorf(FinalSizeError, "final size below received data")
+		}
+		s.finOff = end
+	}
+	s.maxRcvdOff = max(s.maxRcvdOff, end)
+
+	// It is ok if f.Off+int64(len(f.Data)) > s.maxOffAcked: the peer
+	// could've successfuly received MAX_STREAM_DATA, but the packet
+	// acking the MAX_STREAM_DATA was lost.
+	if _, err := s.reassembler.WriteAt(f.Data, f.Off); err != nil {
+		return transportErrorf(FlowControlError, "%v", err)
+	}
 	if !noStreamOffImplicitAck {
-		c.maxStreamOffAcked = max(c.maxStreamOffAcked, s.Off+int64(len(s.Data)))
+		s.maxOffAcked = max(s.maxOffAcked, end)
 	}
 
-	if c.streamReassembler.CanBeRead() {
+	if s.reassembler.CanBeRead() || s.reassembler.ReadOffset() == s.finOff {
 		select {
-		case c.relrcvready <- struct{}{}:
+		case s.rcvready <- struct{}{}:
 		default:
 		}
 	}
@@ -277,3 +450,26 @@ func (c *Conn) handleMsg(m wire.Msg) {
 
 	c.msgBytesRcvd += int64(len(m.Data))
 }
+
+// closeErrorFromFrame returns the error that a CLOSE frame f received from the
+// peer reports.
+func closeErrorFromFrame(f wire.Close) error {
+	switch {
+	case f.Application:
+		return &ApplicationError{
+			Code:   uint64(f.Code),
+			Reason: string(f.Reason),
+			Remote: true,
+		}
+
+	case TransportErrorCode(f.Code) == NoError:
+		return io.ErrClosedPipe
+
+	default:
+		return &TransportError{
+			Code:   TransportErrorCode(f.Code),
+			Reason: string(f.Reason),
+			Remote: true,
+		}
+	}
+}
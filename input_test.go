@@ -0,0 +1,63 @@
+package quic
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/nanokatze/quic-at-home/internal/wire"
+)
+
+// TestHandleAckTruncated checks that only the packets in the gaps between the
+// ranges an ACK reports are declared lost, not the ones below them, which the
+// ACK may have left out to fit, unless the ACK had room for more ranges.
+func TestHandleAckTruncated(t *testing.T) {
+	newConn := func(seq int64, now time.Time) *Conn {
+		rtt := newRTTFilter(0)
+		c := &Conn{
+			seq:                  seq,
+			inFlightPackets:      make(map[wire.PacketNumber]inFlightPacket),
+			congestionController: newCongestionController(minPacketSize, rtt, now),
+			rttFilter:            rtt,
+		}
+		for pn := wire.PacketNumber(0); pn < wire.PacketNumber(seq); pn++ {
+			c.inFlightPackets[pn] = inFlightPacket{containsPing: true, sent: now, size: minPacketSize}
+			c.inFlightBytes += minPacketSize
+		}
+		return c
+	}
+	raddr := netip.MustParseAddrPort("192.0.2.1:1234")
+
+	// An ACK with room to spare reports all the ranges.
+	now := time.Now()
+	c := newConn(10, now)
+	if err := c.handleAck(wire.Ack{Ranges: wire.PacketNumberRanges{{Min: 8, Max: 9}, {Min: 4, Max: 5}}}, raddr, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.inFlightPackets) != 0 {
+		t.Fatalf("%d packets in flight, want none", len(c.inFlightPackets))
+	}
+	if c.bytesNacked != 6*minPacketSize {
+		t.Fatalf("nacked %d bytes, want %d", c.bytesNacked, 6*minPacketSize)
+	}
+
+	// Every other packet was received, more ranges than fit in a packet.
+	c = newConn(2000, now)
+	var ack wire.Ack
+	for pn := wire.PacketNumber(1999); pn > 0; pn -= 2 {
+		ack.Ranges = append(ack.Ranges, wire.PacketNumberRange{Min: pn, Max: pn})
+	}
+	ack.Ranges = ack.Ranges[:wire.AckMaxRangeCount(minPacketSize-12-16, ack)]
+	minPNAcks := ack.Ranges[len(ack.Ranges)-1].Min
+	if err := c.handleAck(ack, raddr, now); err != nil {
+		t.Fatal(err)
+	}
+	for pn := range c.inFlightPackets {
+		if pn > minPNAcks {
+			t.Fatalf("packet %d still in flight, above the ranges reported", pn)
+		}
+	}
+	if len(c.inFlightPackets) != int(minPNAcks) {
+		t.Fatalf("%d packets in flight, want the %d below the ranges reported", len(c.inFlightPackets), minPNAcks)
+	}
+}
@@ -1,19 +1,32 @@
 package sec
 
 import (
+	"crypto/aes"
 	"crypto/cipher"
 	"encoding/binary"
 
+	"golang.org/x/crypto/chacha20"
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
+// keySize is the size of cipher keys, see the Cipher functions section of Noise.
+const keySize = 32
+
 // See The CipherState object section of Noise. This implementation delegates
 // nonce concerns to the user.
 type AEAD interface {
 	Seal(dst []byte, nonce uint64, plaintext, additionalData []byte) []byte
 	Open(dst []byte, nonce uint64, ciphertext, additionalData []byte) ([]byte, error)
+
+	// Rekey returns an AEAD with a new key derived from the current one, see
+	// the Rekey section of Noise. The AEAD Rekey is called on remains
+	// usable.
+	Rekey() AEAD
 }
 
+// rekeyNonce is the nonce reserved for Rekey.
+const rekeyNonce = 1<<64 - 1
+
 // See The ChaChaPoly cipher functions section of Noise.
 type chacha20poly1305AEAD struct {
 	nonceBuf []byte
@@ -42,6 +55,48 @@ func (c *chacha20poly1305AEAD) Open(dst []byte, nonce uint64, ciphertext, additi
 	return c.aead.Open(dst, c.nonceBuf, ciphertext, additionalData)
 }
 
+func (c *chacha20poly1305AEAD) Rekey() AEAD {
+	key := c.Seal(nil, rekeyNonce, make([]byte, keySize), nil)
+	return newChaCha20Poly1305AEAD(key[:keySize])
+}
+
+// See The AESGCM cipher functions section of Noise.
+type aesgcmAEAD struct {
+	nonceBuf []byte
+	aead     cipher.AEAD
+}
+
+func newAESGCMAEAD(key []byte) AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+
+	return &aesgcmAEAD{
+		nonceBuf: make([]byte, 12),
+		aead:     aead,
+	}
+}
+
+func (c *aesgcmAEAD) Seal(dst []byte, nonce uint64, plaintext, additionalData []byte) []byte {
+	binary.BigEndian.PutUint64(c.nonceBuf[4:], nonce)
+	return c.aead.Seal(dst, c.nonceBuf, plaintext, additionalData)
+}
+
+func (c *aesgcmAEAD) Open(dst []byte, nonce uint64, ciphertext, additionalData []byte) ([]byte, error) {
+	binary.BigEndian.PutUint64(c.nonceBuf[4:], nonce)
+	return c.aead.Open(dst, c.nonceBuf, ciphertext, additionalData)
+}
+
+func (c *aesgcmAEAD) Rekey() AEAD {
+	key := c.Seal(nil, rekeyNonce, make([]byte, keySize), nil)
+	return newAESGCMAEAD(key[:keySize])
+}
+
 type nilAEAD struct{}
 
 func (nilAEAD) Seal(dst []byte, nonce uint64, plaintext, additionalData []byte) []byte {
@@ -51,3 +106,53 @@ func (nilAEAD) Seal(dst []byte, nonce uint64, plaintext, additionalData []byte)
 func (nilAEAD) Open(dst []byte, nonce uint64, ciphertext, additionalData []byte) ([]byte, error) {
 	return append(dst, ciphertext...), nil
 }
+
+func (nilAEAD) Rekey() AEAD { return nilAEAD{} }
+
+// HeaderProtection computes the masks that protect packet headers, in the manner
+// of QUIC, see RFC 9001, Section 5.4.
+type HeaderProtection interface {
+	// Mask returns the mask for the header of the packet whose ciphertext
+	// sample is sample. sample must be at least 16 bytes long.
+	Mask(sample []byte) [5]byte
+}
+
+// See RFC 9001, Section 5.4.4.
+type chacha20HeaderProtection struct {
+	key []byte
+}
+
+func newChaCha20HeaderProtection(key []byte) HeaderProtection {
+	return &chacha20HeaderProtection{key: key}
+}
+
+func (h *chacha20HeaderProtection) Mask(sample []byte) [5]byte {
+	c, err := chacha20.NewUnauthenticatedCipher(h.key, sample[4:16])
+	if err != nil {
+		panic(err)
+	}
+	c.SetCounter(binary.LittleEndian.Uint32(sample[0:4]))
+	var mask [5]byte
+	c.XORKeyStream(mask[:], mask[:])
+	return mask
+}
+
+// See RFC 9001, Section 5.4.3.
+type aesHeaderProtection struct {
+	block cipher.Block
+}
+
+func newAESHeaderProtection(key []byte) HeaderProtection {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+
+	return &aesHeaderProtection{block: block}
+}
+
+func (h *aesHeaderProtection) Mask(sample []byte) [5]byte {
+	var buf [aes.BlockSize]byte
+	h.block.Encrypt(buf[:], sample[:aes.BlockSize])
+	return [5]byte(buf[:5])
+}
@@ -0,0 +1,57 @@
+package sec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func TestRekey(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, chacha20poly1305.KeySize)
+
+	// REKEY(k) = ENCRYPT(k, maxnonce, zerolen, zeros), truncated to the key
+	// size.
+	aead, _ := chacha20poly1305.New(key)
+	nonce := []byte{0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	wantKey := aead.Seal(nil, nonce, make([]byte, chacha20poly1305.KeySize), nil)[:chacha20poly1305.KeySize]
+	want := newChaCha20Poly1305AEAD(wantKey)
+
+	a := newChaCha20Poly1305AEAD(key).Rekey()
+	b := newChaCha20Poly1305AEAD(key).Rekey()
+
+	plaintext := []byte("hello")
+	ciphertext := a.Seal(nil, 1, plaintext, nil)
+	if wantCiphertext := want.Seal(nil, 1, plaintext, nil); !bytes.Equal(ciphertext, wantCiphertext) {
+		t.Fatalf("ciphertext = %x, want %x", ciphertext, wantCiphertext)
+	}
+	if got, err := b.Open(nil, 1, ciphertext, nil); err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("Open = %q, %v, want %q, %v", got, err, plaintext, error(nil))
+	}
+	if _, err := newChaCha20Poly1305AEAD(key).Open(nil, 1, ciphertext, nil); err == nil {
+		t.Fatalf("Open with the old key succeeded")
+	}
+}
+
+func TestHeaderProtection(t *testing.T) {
+	// Test vectors from RFC 9001, Appendix A.2 and A.5.
+	tests := []struct {
+		name                string
+		newHeaderProtection func(key []byte) HeaderProtection
+		key, sample, mask   string
+	}{
+		{"AES", newAESHeaderProtection, "9f50449e04a0e810283a1e9933adedd2", "d1b1c98dd7689fb8ec11d242b123dc9b", "437b9aec36"},
+		{"ChaCha20", newChaCha20HeaderProtection, "25a282b9e82f06f21f488917a4fc8f1b73573685608597d0efcb076b0ab7a7a4", "5e5cd55c41f69080575d7999c25a5bfb", "aefefe7d03"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, _ := hex.DecodeString(test.key)
+			sample, _ := hex.DecodeString(test.sample)
+			mask := test.newHeaderProtection(key).Mask(sample)
+			if got := hex.EncodeToString(mask[:]); got != test.mask {
+				t.Fatalf("mask = %s, want %s", got, test.mask)
+			}
+		})
+	}
+}
@@ -1,9 +1,9 @@
 package sec
 
 import (
+	"crypto/mlkem"
+	"errors"
 	"io"
-
-	"golang.org/x/crypto/curve25519"
 )
 
 type Role int
@@ -13,33 +13,141 @@ const (
 	ResponderRole Role = 2
 )
 
+// Pattern is a handshake pattern, see the Handshake patterns section of Noise.
+type Pattern int
+
+const (
+	// PatternIK requires the initiator to know the responder's static
+	// public key. The handshake completes in a single round trip.
+	PatternIK Pattern = iota
+
+	// PatternXX transmits the responder's static public key to the
+	// initiator. The handshake takes three messages.
+	PatternXX
+
+	// PatternIKpsk2 is PatternIK that additionally mixes a pre-shared key
+	// into the second message, see Handshake.SetPresharedKey.
+	PatternIKpsk2
+
+	// PatternIKhybrid is PatternIK where the responder's static key also
+	// has an ML-KEM-768 part. The initiator encapsulates a secret to it,
+	// and sends the ciphertext at the end of the first message (the skem
+	// token), protecting the session from a break of the DH functions. This
+	// modifier is not part of Noise.
+	//
+	// The responder's static private key is the DH private key followed by
+	// the 64-byte ML-KEM seed, and its public key is the DH public key
+	// followed by the ML-KEM encapsulation key.
+	PatternIKhybrid
+)
+
+func (pattern Pattern) String() string {
+	switch pattern {
+	case PatternIK:
+		return "IK"
+	case PatternXX:
+		return "XX"
+	case PatternIKpsk2:
+		return "IKpsk2"
+	case PatternIKhybrid:
+		return "IKhybrid"
+	}
+	return "unknown"
+}
+
 type Handshake interface {
 	ReadMessage(r io.Reader, payloadLen uint16) (payload []byte, err error)
 	WriteMessage(w io.Writer, payload []byte) error
 	Split() (c1 AEAD, c2 AEAD, handshakeHash []byte)
+
+	// HeaderProtection returns the header protection to use along with
+	// the c1 and c2 of Split, respectively. Unlike the AEADs, it is not
+	// rekeyed.
+	HeaderProtection() (h1 HeaderProtection, h2 HeaderProtection)
+
+	// RemoteStaticPublicKey returns the static public key of the remote
+	// party. Unless known in advance, it is only known once the message
+	// carrying it was read.
+	RemoteStaticPublicKey() []byte
+
+	// SetPresharedKey sets the pre-shared key of a pattern with a psk
+	// modifier. The responder of PatternIKpsk2 may set it once it knows
+	// the initiator's static public key.
+	SetPresharedKey(psk []byte)
 }
 
-func NewHandshake(prologue []byte, localStaticPrivateKey, remoteStaticPublicKey []byte, rand io.Reader, role Role) Handshake {
+var errBadKey = errors.New("bad static key")
+
+// NewHandshake returns a new handshake. remoteStaticPublicKey is only used by
+// the initiator of the IK patterns. The static private key may be followed by
+// an ML-KEM seed, which is only used by the responder of PatternIKhybrid.
+func NewHandshake(suite *CipherSuite, pattern Pattern, prologue []byte, localStaticPrivateKey, remoteStaticPublicKey []byte, rand io.Reader, role Role) (Handshake, error) {
 	hs := handshake{
-		symmetric: newSymmetric(),
+		symmetric: newSymmetric(pattern, suite),
 		rand:      rand,
+		initiator: role == InitiatorRole,
+
+		usesPresharedKey: pattern == PatternIKpsk2,
+		hybrid:           pattern == PatternIKhybrid,
 	}
 	hs.mixHash(prologue)
-	hs.localStaticPrivateKey = append([]byte(nil), localStaticPrivateKey...)
 
-	switch role {
-	case InitiatorRole:
-		hs.remoteStaticPublicKey, _ = hs.openAndHash(nil, remoteStaticPublicKey) // can't fail because hs.symmetric.aead is a nilAEAD
-		return &initiatorHandshake{hs}
+	var localStaticKEMSeed []byte
+	switch len(localStaticPrivateKey) {
+	case suite.dhLen:
+	case suite.dhLen + mlkem.SeedSize:
+		localStaticKEMSeed = localStaticPrivateKey[suite.dhLen:]
+	default:
+		return nil, errBadKey
+	}
+	hs.localStaticPrivateKey = append([]byte(nil), localStaticPrivateKey[:suite.dhLen]...)
+
+	ik := pattern == PatternIK || pattern == PatternIKpsk2 || pattern == PatternIKhybrid
+
+	switch {
+	case ik && role == InitiatorRole:
+		n := suite.dhLen
+		if hs.hybrid {
+			n += mlkem.EncapsulationKeySize768
+		}
+		if len(remoteStaticPublicKey) != n {
+			return nil, errBadKey
+		}
+		hs.remoteStaticPublicKey, _ = hs.openAndHash(nil, remoteStaticPublicKey[:suite.dhLen]) // can't fail because hs.symmetric.aead is a nilAEAD
+		if hs.hybrid {
+			var err error
+			hs.remoteStaticKEMPublic, err = mlkem.NewEncapsulationKey768(remoteStaticPublicKey[suite.dhLen:])
+			if err != nil {
+				return nil, err
+			}
+			hs.mixHash(hs.remoteStaticKEMPublic.Bytes())
+		}
+		return &ikInitiatorHandshake{hs}, nil
 
-	case ResponderRole:
-		localStaticPublicKey, err := curve25519.X25519(localStaticPrivateKey, curve25519.Basepoint)
+	case ik && role == ResponderRole:
+		localStaticPublicKey, err := suite.publicKey(hs.localStaticPrivateKey)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 		hs.sealAndHash(nil, localStaticPublicKey)
-		return &responderHandshake{hs}
+		if hs.hybrid {
+			if localStaticKEMSeed == nil {
+				return nil, errBadKey
+			}
+			hs.localStaticKEMKey, err = mlkem.NewDecapsulationKey768(localStaticKEMSeed)
+			if err != nil {
+				return nil, err
+			}
+			hs.mixHash(hs.localStaticKEMKey.EncapsulationKey().Bytes())
+		}
+		return &ikResponderHandshake{hs}, nil
+
+	case pattern == PatternXX && role == InitiatorRole:
+		return &xxInitiatorHandshake{handshake: hs}, nil
+
+	case pattern == PatternXX && role == ResponderRole:
+		return &xxResponderHandshake{handshake: hs}, nil
 	}
 
-	panic("bad role")
+	panic("bad pattern or role")
 }
@@ -1,15 +1,32 @@
 package sec
 
 import (
+	"crypto/mlkem"
+	"errors"
 	"io"
+)
 
-	"golang.org/x/crypto/curve25519"
+var (
+	errUnexpectedMessage = errors.New("unexpected handshake message")
+	errNoPresharedKey    = errors.New("no pre-shared key")
 )
 
 type handshake struct {
 	symmetric
 
-	rand io.Reader
+	rand      io.Reader
+	initiator bool
+
+	// Whether the pattern has a psk modifier, and the pre-shared key to
+	// use, see SetPresharedKey.
+	usesPresharedKey bool
+	presharedKey     []byte
+
+	// Whether the pattern has the hybrid modifier, and the responder's
+	// static ML-KEM-768 keys.
+	hybrid                bool
+	localStaticKEMKey     *mlkem.DecapsulationKey768
+	remoteStaticKEMPublic *mlkem.EncapsulationKey768
 
 	localEphemeralPrivateKey []byte
 	localStaticPrivateKey    []byte
@@ -17,22 +34,151 @@ type handshake struct {
 	remoteStaticPublicKey    []byte
 }
 
+func (hs *handshake) RemoteStaticPublicKey() []byte {
+	return append([]byte(nil), hs.remoteStaticPublicKey...)
+}
+
+// SetPresharedKey sets the pre-shared key. It must be set before the message
+// carrying the psk token is written or read.
+func (hs *handshake) SetPresharedKey(psk []byte) {
+	hs.presharedKey = append([]byte(nil), psk...)
+}
+
 func (hs *handshake) generateLocalEphemeralPrivateKey() error {
-	hs.localEphemeralPrivateKey = make([]byte, curve25519.ScalarSize)
+	hs.localEphemeralPrivateKey = make([]byte, hs.suite.dhLen)
 	_, err := io.ReadFull(hs.rand, hs.localEphemeralPrivateKey)
 	return err
 }
 
-func (hs *handshake) ee() error {
-	x, err := curve25519.X25519(hs.localEphemeralPrivateKey, hs.remoteEphemeralPublicKey)
-	if err == nil {
-		hs.mixKey(x)
+// writeE processes the e token of a message being written.
+func (hs *handshake) writeE(w io.Writer) error {
+	if err := hs.generateLocalEphemeralPrivateKey(); err != nil {
+		return err
+	}
+	localEphemeralPublicKey, err := hs.suite.publicKey(hs.localEphemeralPrivateKey)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := w.Write(localEphemeralPublicKey); err != nil {
+		return err
+	}
+	hs.mixHash(localEphemeralPublicKey)
+	if hs.usesPresharedKey {
+		hs.mixKey(localEphemeralPublicKey)
 	}
+	return nil
+}
+
+// readE processes the e token of a message being read.
+func (hs *handshake) readE(r io.Reader) error {
+	hs.remoteEphemeralPublicKey = make([]byte, hs.suite.dhLen)
+	if _, err := io.ReadFull(r, hs.remoteEphemeralPublicKey); err != nil {
+		return err
+	}
+	hs.mixHash(hs.remoteEphemeralPublicKey)
+	if hs.usesPresharedKey {
+		hs.mixKey(hs.remoteEphemeralPublicKey)
+	}
+	return nil
+}
+
+// writeS processes the s token of a message being written.
+func (hs *handshake) writeS(w io.Writer) error {
+	localStaticPublicKey, err := hs.suite.publicKey(hs.localStaticPrivateKey)
+	if err != nil {
+		panic(err)
+	}
+	_, err = w.Write(hs.sealAndHash(nil, localStaticPublicKey))
+	return err
+}
+
+// readS processes the s token of a message being read.
+func (hs *handshake) readS(r io.Reader) error {
+	sealedRemoteStaticPublicKey := make([]byte, hs.suite.dhLen+hs.overhead())
+	if _, err := io.ReadFull(r, sealedRemoteStaticPublicKey); err != nil {
+		return err
+	}
+	var err error
+	hs.remoteStaticPublicKey, err = hs.openAndHash(nil, sealedRemoteStaticPublicKey)
+	return err
+}
+
+func (hs *handshake) writePayload(w io.Writer, payload []byte) error {
+	_, err := w.Write(hs.sealAndHash(nil, payload))
 	return err
 }
 
+func (hs *handshake) readPayload(r io.Reader, payloadLen uint16) ([]byte, error) {
+	sealedPayload := make([]byte, int(payloadLen)+hs.overhead())
+	if _, err := io.ReadFull(r, sealedPayload); err != nil {
+		return nil, err
+	}
+	return hs.openAndHash(nil, sealedPayload)
+}
+
+// writeSKEM processes the skem token of a message being written: it
+// encapsulates a secret to the responder's static ML-KEM key.
+func (hs *handshake) writeSKEM(w io.Writer) error {
+	secret, ciphertext := hs.remoteStaticKEMPublic.Encapsulate()
+	if _, err := w.Write(hs.sealAndHash(nil, ciphertext)); err != nil {
+		return err
+	}
+	hs.mixKey(secret)
+	return nil
+}
+
+// readSKEM processes the skem token of a message being read.
+func (hs *handshake) readSKEM(r io.Reader) error {
+	sealedCiphertext := make([]byte, mlkem.CiphertextSize768+hs.overhead())
+	if _, err := io.ReadFull(r, sealedCiphertext); err != nil {
+		return err
+	}
+	ciphertext, err := hs.openAndHash(nil, sealedCiphertext)
+	if err != nil {
+		return err
+	}
+	secret, err := hs.localStaticKEMKey.Decapsulate(ciphertext)
+	if err != nil {
+		return err
+	}
+	hs.mixKey(secret)
+	return nil
+}
+
+func (hs *handshake) ee() error {
+	return hs.mixDH(hs.localEphemeralPrivateKey, hs.remoteEphemeralPublicKey)
+}
+
+// es is DH(e, rs) for the initiator and DH(s, re) for the responder.
+func (hs *handshake) es() error {
+	if hs.initiator {
+		return hs.mixDH(hs.localEphemeralPrivateKey, hs.remoteStaticPublicKey)
+	}
+	return hs.mixDH(hs.localStaticPrivateKey, hs.remoteEphemeralPublicKey)
+}
+
+// se is DH(s, re) for the initiator and DH(e, rs) for the responder.
+func (hs *handshake) se() error {
+	if hs.initiator {
+		return hs.mixDH(hs.localStaticPrivateKey, hs.remoteEphemeralPublicKey)
+	}
+	return hs.mixDH(hs.localEphemeralPrivateKey, hs.remoteStaticPublicKey)
+}
+
 func (hs *handshake) ss() error {
-	x, err := curve25519.X25519(hs.localStaticPrivateKey, hs.remoteStaticPublicKey)
+	return hs.mixDH(hs.localStaticPrivateKey, hs.remoteStaticPublicKey)
+}
+
+func (hs *handshake) psk() error {
+	if hs.presharedKey == nil {
+		return errNoPresharedKey
+	}
+	hs.mixKeyAndHash(hs.presharedKey)
+	return nil
+}
+
+func (hs *handshake) mixDH(privateKey, publicKey []byte) error {
+	x, err := hs.suite.dh(privateKey, publicKey)
 	if err == nil {
 		hs.mixKey(x)
 	}
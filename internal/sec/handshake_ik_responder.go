@@ -0,0 +1,50 @@
+package sec
+
+import "io"
+
+type ikResponderHandshake struct {
+	handshake
+}
+
+func (hs *ikResponderHandshake) ReadMessage(r io.Reader, payloadLen uint16) ([]byte, error) {
+	// → e, es, s, ss, and skem for IKhybrid
+
+	if err := hs.readE(r); err != nil {
+		return nil, err
+	}
+	if err := hs.es(); err != nil {
+		return nil, err
+	}
+	if err := hs.readS(r); err != nil {
+		return nil, err
+	}
+	if err := hs.ss(); err != nil {
+		return nil, err
+	}
+	if hs.hybrid {
+		if err := hs.readSKEM(r); err != nil {
+			return nil, err
+		}
+	}
+	return hs.readPayload(r, payloadLen)
+}
+
+func (hs *ikResponderHandshake) WriteMessage(w io.Writer, payload []byte) error {
+	// ← e, ee, se, and psk for IKpsk2
+
+	if err := hs.writeE(w); err != nil {
+		return err
+	}
+	if err := hs.ee(); err != nil {
+		return err
+	}
+	if err := hs.se(); err != nil {
+		return err
+	}
+	if hs.usesPresharedKey {
+		if err := hs.psk(); err != nil {
+			return err
+		}
+	}
+	return hs.writePayload(w, payload)
+}
@@ -2,6 +2,7 @@ package sec
 
 import (
 	"bytes"
+	"crypto/mlkem"
 	_ "embed"
 	"encoding/hex"
 	"encoding/json"
@@ -33,6 +34,18 @@ type Vector struct {
 	}
 }
 
+var cipherSuites = []*CipherSuite{
+	CipherSuite25519ChaChaPolyBLAKE2b,
+	CipherSuite25519AESGCMSHA256,
+}
+
+// patterns maps the handshake patterns to the number of their messages.
+var patterns = map[Pattern]int{
+	PatternIK:     2,
+	PatternXX:     3,
+	PatternIKpsk2: 2,
+}
+
 func TestHandshake(t *testing.T) {
 	var cacophony struct {
 		Vectors []*Vector `json:"vectors"`
@@ -41,22 +54,48 @@ func TestHandshake(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	v := vectorByName(cacophony.Vectors, "Noise_IK_25519_ChaChaPoly_BLAKE2b")
+	for pattern, n := range patterns {
+		for _, suite := range cipherSuites {
+			name := "Noise_" + pattern.String() + "_" + suite.Name()
+			t.Run(name, func(t *testing.T) {
+				v := vectorByName(cacophony.Vectors, name)
+				if v == nil {
+					t.Fatal("no test vector")
+				}
+				testHandshake(t, suite, pattern, n, v)
+			})
+		}
+	}
+}
 
+func testHandshake(t *testing.T, suite *CipherSuite, pattern Pattern, n int, v *Vector) {
 	alicePrologue, _ := hex.DecodeString(v.InitPrologue)
 	aliceLocalStatic, _ := hex.DecodeString(v.InitLocalStatic)
 	aliceEphemeral, _ := hex.DecodeString(v.InitEphemeral)
 	aliceRemoteStatic, _ := hex.DecodeString(v.InitRemoteStatic)
-	alice := NewHandshake(alicePrologue, aliceLocalStatic, aliceRemoteStatic, bytes.NewReader(aliceEphemeral), InitiatorRole)
+	alice, err := NewHandshake(suite, pattern, alicePrologue, aliceLocalStatic, aliceRemoteStatic, bytes.NewReader(aliceEphemeral), InitiatorRole)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	bobPrologue, _ := hex.DecodeString(v.RespPrologue)
 	bobLocalStatic, _ := hex.DecodeString(v.RespLocalStatic)
 	bobEphemeral, _ := hex.DecodeString(v.RespEphemeral)
-	bob := NewHandshake(bobPrologue, bobLocalStatic, nil, bytes.NewReader(bobEphemeral), ResponderRole)
+	bob, err := NewHandshake(suite, pattern, bobPrologue, bobLocalStatic, nil, bytes.NewReader(bobEphemeral), ResponderRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(v.InitPSKs) > 0 {
+		alicePSK, _ := hex.DecodeString(v.InitPSKs[0])
+		alice.SetPresharedKey(alicePSK)
+		bobPSK, _ := hex.DecodeString(v.RespPSKs[0])
+		bob.SetPresharedKey(bobPSK)
+	}
 
 	aliceAndBob := []Handshake{alice, bob}
 
-	for i, m := range v.Messages[:2] {
+	for i, m := range v.Messages[:n] {
 		sender := aliceAndBob[i%2]
 		recipient := aliceAndBob[1-i%2]
 
@@ -80,6 +119,15 @@ func TestHandshake(t *testing.T) {
 		}
 	}
 
+	aliceLocalStaticPublic, _ := suite.publicKey(aliceLocalStatic)
+	if got := bob.RemoteStaticPublicKey(); !bytes.Equal(got, aliceLocalStaticPublic) {
+		t.Errorf("bob's remote static public key = %x, want %x", got, aliceLocalStaticPublic)
+	}
+	bobLocalStaticPublic, _ := suite.publicKey(bobLocalStatic)
+	if got := alice.RemoteStaticPublicKey(); !bytes.Equal(got, bobLocalStaticPublic) {
+		t.Errorf("alice's remote static public key = %x, want %x", got, bobLocalStaticPublic)
+	}
+
 	wantHandshakeHash, _ := hex.DecodeString(v.HandshakeHash)
 
 	a1, a2, aliceHandshakeHash := alice.Split()
@@ -92,21 +140,26 @@ func TestHandshake(t *testing.T) {
 		t.Errorf("bob's handshake hash = %x, want %x", bobHandshakeHash, wantHandshakeHash)
 	}
 
+	// The messages keep alternating between alice and bob after the
+	// handshake.
 	encrypt := []AEAD{a1, b2}
 	decrypt := []AEAD{b1, a2}
+	nonces := []uint64{0, 0}
 
-	for i, m := range v.Messages[2:] {
-		nonce := uint64(i / 2)
+	for i, m := range v.Messages[n:] {
+		sender := (n + i) % 2
+		nonce := nonces[sender]
+		nonces[sender]++
 
 		wantPayload, _ := hex.DecodeString(m.Payload)
 		wantCiphertext, _ := hex.DecodeString(m.Ciphertext)
 
-		ciphertext := encrypt[i%2].Seal(nil, nonce, wantPayload, nil)
+		ciphertext := encrypt[sender].Seal(nil, nonce, wantPayload, nil)
 		if !bytes.Equal(ciphertext, wantCiphertext) {
 			t.Fatalf("%d: ciphertext = %x, want %x", i, ciphertext, wantCiphertext)
 		}
 
-		payload, err := decrypt[i%2].Open(nil, nonce, ciphertext, nil)
+		payload, err := decrypt[sender].Open(nil, nonce, ciphertext, nil)
 		if err != nil {
 			t.Fatalf("%d: %v", i, err)
 		}
@@ -114,6 +167,16 @@ func TestHandshake(t *testing.T) {
 			t.Fatalf("%d: payload = %x, want %x", i, payload, wantPayload)
 		}
 	}
+
+	ah1, ah2 := alice.HeaderProtection()
+	bh1, bh2 := bob.HeaderProtection()
+	sample := make([]byte, 16)
+	if ah1.Mask(sample) != bh1.Mask(sample) || ah2.Mask(sample) != bh2.Mask(sample) {
+		t.Errorf("header protection differs")
+	}
+	if ah1.Mask(sample) == ah2.Mask(sample) {
+		t.Errorf("header protection is the same in both directions")
+	}
 }
 
 func vectorByName(vectors []*Vector, name string) *Vector {
@@ -125,6 +188,106 @@ func vectorByName(vectors []*Vector, name string) *Vector {
 	return nil
 }
 
+func TestPresharedKeyMismatch(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+
+	alicePrivKey, _ := hex.DecodeString("e61ef9919cde45dd5f82166404bd08e38bceb5dfdfded0a34c8df7ed542214d1")
+	bobPrivKey, _ := hex.DecodeString("4a3acbfdb163dec651dfa3194dece676d437029c62a408b4c5ea9114246e4893")
+	bobPubKey, _ := curve25519.X25519(bobPrivKey, curve25519.Basepoint)
+
+	alice, _ := NewHandshake(CipherSuite25519ChaChaPolyBLAKE2b, PatternIKpsk2, nil, alicePrivKey, bobPubKey, r, InitiatorRole)
+	alice.SetPresharedKey(bytes.Repeat([]byte{1}, 32))
+	bob, _ := NewHandshake(CipherSuite25519ChaChaPolyBLAKE2b, PatternIKpsk2, nil, bobPrivKey, nil, r, ResponderRole)
+
+	buf := bytes.Buffer{}
+	if err := alice.WriteMessage(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The pre-shared key isn't used until the second message.
+	if _, err := bob.ReadMessage(&buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	bob.SetPresharedKey(bytes.Repeat([]byte{2}, 32))
+	if err := bob.WriteMessage(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.ReadMessage(&buf, 0); err == nil {
+		t.Fatal("ReadMessage succeeded despite mismatched pre-shared keys")
+	}
+}
+
+func TestHybridHandshake(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+
+	alicePrivKey, _ := hex.DecodeString("e61ef9919cde45dd5f82166404bd08e38bceb5dfdfded0a34c8df7ed542214d1")
+	bobPrivKey, _ := hex.DecodeString("4a3acbfdb163dec651dfa3194dece676d437029c62a408b4c5ea9114246e4893")
+	bobPubKey, _ := curve25519.X25519(bobPrivKey, curve25519.Basepoint)
+
+	bobKEMKey, _ := mlkem.GenerateKey768()
+	bobPrivKey = append(bobPrivKey, bobKEMKey.Bytes()...)
+	bobPubKey = append(bobPubKey, bobKEMKey.EncapsulationKey().Bytes()...)
+
+	otherKEMKey, _ := mlkem.GenerateKey768()
+	otherPrivKey := append(bobPrivKey[:32:32], otherKEMKey.Bytes()...)
+
+	for _, test := range []struct {
+		name       string
+		bobPrivKey []byte
+		wantErr    bool
+	}{
+		{"same keys", bobPrivKey, false},
+		{"different ML-KEM keys", otherPrivKey, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			alice, err := NewHandshake(CipherSuite25519ChaChaPolyBLAKE2b, PatternIKhybrid, nil, alicePrivKey, bobPubKey, r, InitiatorRole)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob, err := NewHandshake(CipherSuite25519ChaChaPolyBLAKE2b, PatternIKhybrid, nil, test.bobPrivKey, nil, r, ResponderRole)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			payload := []byte("hello")
+			buf := bytes.Buffer{}
+			if err := alice.WriteMessage(&buf, payload); err != nil {
+				t.Fatal(err)
+			}
+			if want := 32 + (32 + 16) + (mlkem.CiphertextSize768 + 16) + len(payload) + 16; buf.Len() != want {
+				t.Fatalf("message length = %d, want %d", buf.Len(), want)
+			}
+			got, err := bob.ReadMessage(&buf, uint16(len(payload)))
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("ReadMessage succeeded despite mismatched ML-KEM keys")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("payload = %q, want %q", got, payload)
+			}
+			if err := bob.WriteMessage(&buf, nil); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := alice.ReadMessage(&buf, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			a1, _, aliceHandshakeHash := alice.Split()
+			b1, _, bobHandshakeHash := bob.Split()
+			if !bytes.Equal(aliceHandshakeHash, bobHandshakeHash) {
+				t.Fatalf("handshake hashes differ: %x and %x", aliceHandshakeHash, bobHandshakeHash)
+			}
+			if _, err := b1.Open(nil, 0, a1.Seal(nil, 0, payload, nil), nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
 func BenchmarkHandshake(b *testing.B) {
 	r := rand.New(rand.NewSource(42))
 
@@ -135,8 +298,8 @@ func BenchmarkHandshake(b *testing.B) {
 
 	buf := bytes.Buffer{}
 	for i := 0; i < b.N; i++ {
-		alice := NewHandshake(prologue, alicePrivKey, bobPubKey, r, InitiatorRole)
-		bob := NewHandshake(prologue, bobPrivKey, nil, r, ResponderRole)
+		alice, _ := NewHandshake(CipherSuite25519ChaChaPolyBLAKE2b, PatternIK, prologue, alicePrivKey, bobPubKey, r, InitiatorRole)
+		bob, _ := NewHandshake(CipherSuite25519ChaChaPolyBLAKE2b, PatternIK, prologue, bobPrivKey, nil, r, ResponderRole)
 
 		if err := alice.WriteMessage(&buf, nil); err != nil {
 			b.Fatal(err)
@@ -0,0 +1,59 @@
+package sec
+
+import "io"
+
+type xxInitiatorHandshake struct {
+	handshake
+	msg int // index of the next message
+}
+
+func (hs *xxInitiatorHandshake) ReadMessage(r io.Reader, payloadLen uint16) ([]byte, error) {
+	if hs.msg != 1 {
+		return nil, errUnexpectedMessage
+	}
+	hs.msg++
+
+	// ← e, ee, s, es
+
+	if err := hs.readE(r); err != nil {
+		return nil, err
+	}
+	if err := hs.ee(); err != nil {
+		return nil, err
+	}
+	if err := hs.readS(r); err != nil {
+		return nil, err
+	}
+	if err := hs.es(); err != nil {
+		return nil, err
+	}
+	return hs.readPayload(r, payloadLen)
+}
+
+func (hs *xxInitiatorHandshake) WriteMessage(w io.Writer, payload []byte) error {
+	switch hs.msg {
+	case 0:
+		hs.msg++
+
+		// → e
+
+		if err := hs.writeE(w); err != nil {
+			return err
+		}
+		return hs.writePayload(w, payload)
+
+	case 2:
+		hs.msg++
+
+		// → s, se
+
+		if err := hs.writeS(w); err != nil {
+			return err
+		}
+		if err := hs.se(); err != nil {
+			return err
+		}
+		return hs.writePayload(w, payload)
+	}
+	return errUnexpectedMessage
+}
@@ -0,0 +1,59 @@
+package sec
+
+import "io"
+
+type xxResponderHandshake struct {
+	handshake
+	msg int // index of the next message
+}
+
+func (hs *xxResponderHandshake) ReadMessage(r io.Reader, payloadLen uint16) ([]byte, error) {
+	switch hs.msg {
+	case 0:
+		hs.msg++
+
+		// → e
+
+		if err := hs.readE(r); err != nil {
+			return nil, err
+		}
+		return hs.readPayload(r, payloadLen)
+
+	case 2:
+		hs.msg++
+
+		// → s, se
+
+		if err := hs.readS(r); err != nil {
+			return nil, err
+		}
+		if err := hs.se(); err != nil {
+			return nil, err
+		}
+		return hs.readPayload(r, payloadLen)
+	}
+	return nil, errUnexpectedMessage
+}
+
+func (hs *xxResponderHandshake) WriteMessage(w io.Writer, payload []byte) error {
+	if hs.msg != 1 {
+		return errUnexpectedMessage
+	}
+	hs.msg++
+
+	// ← e, ee, s, es
+
+	if err := hs.writeE(w); err != nil {
+		return err
+	}
+	if err := hs.ee(); err != nil {
+		return err
+	}
+	if err := hs.writeS(w); err != nil {
+		return err
+	}
+	if err := hs.es(); err != nil {
+		return err
+	}
+	return hs.writePayload(w, payload)
+}
@@ -1,5 +1,7 @@
 /*
-sec is an implementation of Noise_IK_25519_ChaChaPoly_BLAKE2b protocol.
+sec is an implementation of the IK, IKpsk2 and XX patterns of Noise protocol,
+with the 25519_ChaChaPoly_BLAKE2b and 25519_AESGCM_SHA256 cipher suites. IK
+can also be hybridized with ML-KEM-768, see PatternIKhybrid.
 
 Trevor Perrin. 2016. The Noise Protocol Framework.
 https://noiseprotocol.org/noise.pdf
@@ -0,0 +1,66 @@
+package sec
+
+import (
+	"crypto/sha256"
+	"hash"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/curve25519"
+)
+
+// CipherSuite is a combination of the DH functions, the cipher functions and the
+// hash function, see the Crypto functions section of Noise.
+type CipherSuite struct {
+	name string // e.g. 25519_ChaChaPoly_BLAKE2b
+
+	// DH functions
+	dhLen     int
+	dh        func(privateKey, publicKey []byte) ([]byte, error)
+	publicKey func(privateKey []byte) ([]byte, error)
+
+	// Cipher functions
+	newAEAD             func(key []byte) AEAD
+	newHeaderProtection func(key []byte) HeaderProtection
+
+	// Hash function
+	newHash func() hash.Hash
+}
+
+// Name returns the name of suite as it appears in the Noise protocol name.
+func (suite *CipherSuite) Name() string { return suite.name }
+
+// DHLen returns the size of public keys used with suite.
+func (suite *CipherSuite) DHLen() int { return suite.dhLen }
+
+var (
+	CipherSuite25519ChaChaPolyBLAKE2b = &CipherSuite{
+		name:      "25519_ChaChaPoly_BLAKE2b",
+		dhLen:     curve25519.PointSize,
+		dh:        curve25519.X25519,
+		publicKey: x25519PublicKey,
+		newAEAD:   newChaCha20Poly1305AEAD,
+		newHash:   newBLAKE2b,
+
+		newHeaderProtection: newChaCha20HeaderProtection,
+	}
+
+	CipherSuite25519AESGCMSHA256 = &CipherSuite{
+		name:      "25519_AESGCM_SHA256",
+		dhLen:     curve25519.PointSize,
+		dh:        curve25519.X25519,
+		publicKey: x25519PublicKey,
+		newAEAD:   newAESGCMAEAD,
+		newHash:   sha256.New,
+
+		newHeaderProtection: newAESHeaderProtection,
+	}
+)
+
+func x25519PublicKey(privateKey []byte) ([]byte, error) {
+	return curve25519.X25519(privateKey, curve25519.Basepoint)
+}
+
+func newBLAKE2b() hash.Hash {
+	hash, _ := blake2b.New512(nil)
+	return hash
+}
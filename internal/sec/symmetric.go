@@ -1,73 +1,101 @@
 package sec
 
-import (
-	"crypto/hmac"
-	"hash"
-
-	"golang.org/x/crypto/blake2b"
-)
+import "crypto/hmac"
 
 // See The SymmetricState object section of Noise.
 type symmetric struct {
+	suite *CipherSuite
+
 	aead        AEAD
 	nonce       uint64
 	chainingKey []byte
 	hash        []byte
 }
 
-func newSymmetric() symmetric {
-	s := symmetric{aead: nilAEAD{}}
-	s.hash = []byte("Noise_IK_25519_ChaChaPoly_BLAKE2b\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+func newSymmetric(pattern Pattern, suite *CipherSuite) symmetric {
+	s := symmetric{
+		suite: suite,
+		aead:  nilAEAD{},
+	}
+	protocolName := []byte("Noise_" + pattern.String() + "_" + suite.name)
+	if hashLen := suite.newHash().Size(); len(protocolName) <= hashLen {
+		s.hash = make([]byte, hashLen)
+		copy(s.hash, protocolName)
+	} else {
+		s.hash = s.sum(protocolName)
+	}
 	s.chainingKey = append([]byte(nil), s.hash...)
 	return s
 }
 
+func (s *symmetric) sum(data ...[]byte) []byte {
+	hash := s.suite.newHash()
+	for _, data := range data {
+		hash.Write(data)
+	}
+	return hash.Sum(nil)
+}
+
 func (s *symmetric) mixHash(data []byte) {
-	hash, _ := blake2b.New512(nil)
-	hash.Write(s.hash)
-	hash.Write(data)
-	s.hash = hash.Sum(nil)
+	s.hash = s.sum(s.hash, data)
 }
 
-func (s *symmetric) mixKey(inputKeyMaterial []byte) {
-	mac := hmac.New(func() hash.Hash {
-		hash, _ := blake2b.New512(nil)
-		return hash
-	}, s.chainingKey)
+// hkdf is HKDF with n outputs, see the Hash functions section of Noise. Noise
+// only uses 2 or 3 outputs, HeaderProtection uses 4.
+func (s *symmetric) hkdf(inputKeyMaterial []byte, n int) [][]byte {
+	mac := hmac.New(s.suite.newHash, s.chainingKey)
 	mac.Write(inputKeyMaterial)
 	tempKey := mac.Sum(nil)
-	mac2 := hmac.New(func() hash.Hash {
-		hash, _ := blake2b.New512(nil)
-		return hash
-	}, tempKey)
-	mac2.Write([]byte{0x01})
-	output1 := mac2.Sum(nil)
-	mac2.Reset()
-	mac2.Write(output1)
-	mac2.Write([]byte{0x02})
-	output2 := mac2.Sum(nil)
-	s.aead = newChaCha20Poly1305AEAD(output2[:32])
+	mac2 := hmac.New(s.suite.newHash, tempKey)
+	var outputs [][]byte
+	var output []byte
+	for i := 1; i <= n; i++ {
+		mac2.Reset()
+		mac2.Write(output)
+		mac2.Write([]byte{byte(i)})
+		output = mac2.Sum(nil)
+		outputs = append(outputs, output)
+	}
+	return outputs
+}
+
+func (s *symmetric) mixKey(inputKeyMaterial []byte) {
+	outputs := s.hkdf(inputKeyMaterial, 2)
+	s.aead = s.suite.newAEAD(outputs[1][:keySize])
+	s.nonce = 0
+	s.chainingKey = outputs[0]
+}
+
+// mixKeyAndHash is used for pre-shared keys, see the Handshake patterns section
+// of Noise.
+func (s *symmetric) mixKeyAndHash(inputKeyMaterial []byte) {
+	outputs := s.hkdf(inputKeyMaterial, 3)
+	s.chainingKey = outputs[0]
+	s.mixHash(outputs[1])
+	s.aead = s.suite.newAEAD(outputs[2][:keySize])
 	s.nonce = 0
-	s.chainingKey = output1
 }
 
 func (s *symmetric) Split() (AEAD, AEAD, []byte) {
-	mac := hmac.New(func() hash.Hash {
-		hash, _ := blake2b.New512(nil)
-		return hash
-	}, s.chainingKey)
-	tempKey := mac.Sum(nil)
-	mac2 := hmac.New(func() hash.Hash {
-		hash, _ := blake2b.New512(nil)
-		return hash
-	}, tempKey)
-	mac2.Write([]byte{0x01})
-	output1 := mac2.Sum(nil)
-	mac2.Reset()
-	mac2.Write(output1)
-	mac2.Write([]byte{0x02})
-	output2 := mac2.Sum(nil)
-	return newChaCha20Poly1305AEAD(output1[:32]), newChaCha20Poly1305AEAD(output2[:32]), append([]byte(nil), s.hash...)
+	outputs := s.hkdf(nil, 2)
+	return s.suite.newAEAD(outputs[0][:keySize]), s.suite.newAEAD(outputs[1][:keySize]), append([]byte(nil), s.hash...)
+}
+
+// HeaderProtection returns the header protection for each direction, keyed with
+// the third and fourth outputs of the HKDF that Split takes its keys from.
+// Split's keys, the first two outputs, are thus unaffected.
+func (s *symmetric) HeaderProtection() (HeaderProtection, HeaderProtection) {
+	outputs := s.hkdf(nil, 4)
+	return s.suite.newHeaderProtection(outputs[2][:keySize]), s.suite.newHeaderProtection(outputs[3][:keySize])
+}
+
+// overhead returns the size of the authentication tag added by sealAndHash.
+// Before a key is mixed in, sealAndHash adds none.
+func (s *symmetric) overhead() int {
+	if _, ok := s.aead.(nilAEAD); ok {
+		return 0
+	}
+	return 16
 }
 
 func (s *symmetric) sealAndHash(dst, plaintext []byte) []byte {
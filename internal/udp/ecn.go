@@ -0,0 +1,15 @@
+package udp
+
+// ECN is an Explicit Congestion Notification codepoint, the two least
+// significant bits of the IPv4 TOS and the IPv6 Traffic Class fields. See RFC
+// 3168, Section 5.
+type ECN byte
+
+const (
+	NotECT ECN = 0b00 // the sender doesn't support ECN
+	ECT1   ECN = 0b01
+	ECT0   ECN = 0b10
+	CE     ECN = 0b11 // Congestion Experienced, set by a router instead of dropping the packet
+
+	ecnMask = 0b11
+)
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package udp
+
+import "errors"
+
+func (c *PacketConn) setRecvTOS(recv bool) error {
+	return errors.New("not implemented")
+}
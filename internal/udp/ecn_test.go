@@ -0,0 +1,61 @@
+package udp
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestECN(t *testing.T) {
+	for _, test := range []struct {
+		laddr netip.AddrPort
+		raddr netip.Addr
+	}{
+		{netip.MustParseAddrPort("127.0.0.1:0"), netip.MustParseAddr("127.0.0.1")},
+		{netip.MustParseAddrPort("[::1]:0"), netip.MustParseAddr("::1")},
+		{netip.MustParseAddrPort("[::]:0"), netip.MustParseAddr("::ffff:127.0.0.1")}, // IPv4 on a dual-stack socket
+	} {
+		t.Run(test.raddr.String(), func(t *testing.T) {
+			pconn, err := ListenAddrPort(test.laddr)
+			if err != nil {
+				t.Skip(err)
+			}
+			defer pconn.Close()
+			raddr := netip.AddrPortFrom(test.raddr, pconn.LocalAddr().(*net.UDPAddr).AddrPort().Port())
+
+			for _, ecn := range []ECN{NotECT, ECT0, ECT1, CE} {
+				if _, err := pconn.WriteToUDPAddrPortGSO(make([]byte, 1200), 1200, ecn, raddr); err != nil {
+					t.Fatal(err)
+				}
+
+				pconn.SetReadDeadline(time.Now().Add(time.Second))
+				buf := make([]byte, 65536)
+				n, _, got, _, err := pconn.ReadFromUDPAddrPortGRO(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != 1200 {
+					t.Fatalf("n = %d, want 1200", n)
+				}
+				if got != ecn {
+					t.Errorf("ecn = %02b, want %02b", got, ecn)
+				}
+			}
+		})
+	}
+}
+
+// TestReadError checks that reading from a closed connection fails instead of
+// reporting an empty packet.
+func TestReadError(t *testing.T) {
+	pconn, err := ListenAddrPort(netip.MustParseAddrPort("127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pconn.Close()
+
+	if n, _, _, _, err := pconn.ReadFromUDPAddrPortGRO(make([]byte, 65536)); err == nil {
+		t.Fatalf("n = %d, err = nil, want non-nil", n)
+	}
+}
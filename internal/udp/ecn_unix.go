@@ -0,0 +1,33 @@
+//go:build linux
+
+package udp
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// setRecvTOS makes reads report the ECN codepoint of the packets. An IPv6
+// socket needs both options, as it may receive IPv4 packets too.
+func (c *PacketConn) setRecvTOS(recv bool) error {
+	sc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	v := 0
+	if recv {
+		v = 1
+	}
+	var err4, err6 error
+	if err := sc.Control(func(fd uintptr) {
+		err4 = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVTOS, v)
+		err6 = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, v)
+	}); err != nil {
+		return err
+	}
+	if err4 != nil && err6 != nil {
+		return errors.Join(err4, err6)
+	}
+	return nil
+}
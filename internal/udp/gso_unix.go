@@ -14,13 +14,17 @@ const (
 	unix_UDP_GRO     = 0x68
 )
 
-func (c *PacketConn) readFromUDPAddrPortGRO(b []byte) (int, int, netip.AddrPort, error) {
-	oob := make([]byte, 24)
+func (c *PacketConn) readFromUDPAddrPortGRO(b []byte) (int, int, ECN, netip.AddrPort, error) {
+	oob := make([]byte, 2*unix.CmsgSpace(4))
 	n, oobn, flags, raddr, err := c.ReadMsgUDPAddrPort(b, oob)
+	if err != nil {
+		return 0, 0, 0, netip.AddrPort{}, err
+	}
 	if flags&unix.MSG_CTRUNC != 0 {
 		panic("oob buffer too small")
 	}
 	ss := n
+	ecn := NotECT
 	// TOOD: don't use ParseSocketControlMessage as this allocs and causes
 	// oob to leak to heap as well
 	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
@@ -31,14 +35,25 @@ func (c *PacketConn) readFromUDPAddrPortGRO(b []byte) (int, int, netip.AddrPort,
 		switch {
 		case m.Header.Level == unix_SOL_UDP && m.Header.Type == unix_UDP_GRO:
 			ss = int(*(*uint16)(unsafe.Pointer(&m.Data[0])))
+		case m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_TOS:
+			ecn = ECN(m.Data[0]) & ecnMask
+		case m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_TCLASS:
+			ecn = ECN(*(*int32)(unsafe.Pointer(&m.Data[0]))) & ecnMask
 		}
 	}
-	return n, ss, raddr, err
+	return n, ss, ecn, raddr, nil
 }
 
-func (c *PacketConn) writeToUDPAddrPortGSO(b []byte, ss int, raddr netip.AddrPort) (int, error) {
+func (c *PacketConn) writeToUDPAddrPortGSO(b []byte, ss int, ecn ECN, raddr netip.AddrPort) (int, error) {
 	// TODO: solve this allocing
 	oob := unix_SegmentSize(uint16(ss))
+	if ecn != NotECT {
+		if raddr.Addr().Unmap().Is4() {
+			oob = append(oob, unix_TrafficClass(unix.IPPROTO_IP, unix.IP_TOS, int32(ecn))...)
+		} else {
+			oob = append(oob, unix_TrafficClass(unix.IPPROTO_IPV6, unix.IPV6_TCLASS, int32(ecn))...)
+		}
+	}
 
 	segs := max(60000/ss, 1) // TODO: pick a better constant
 
@@ -80,6 +95,18 @@ func unix_SegmentSize(ss uint16) []byte {
 	return b
 }
 
+// unix_TrafficClass returns an IP_TOS or IPV6_TCLASS control message, as
+// selected by level and typ. Both take an int.
+func unix_TrafficClass(level, typ int32, tc int32) []byte {
+	b := make([]byte, unix.CmsgSpace(4))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = level
+	h.Type = typ
+	h.SetLen(unix.CmsgLen(4))
+	*(*int32)(unix_Cmsghdr_data(h, 0)) = tc
+	return b
+}
+
 /*
 func unix_ParseSegmentSize(b []byte) (int, error) {
 }
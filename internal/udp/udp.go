@@ -7,6 +7,10 @@ import (
 	"net/netip"
 )
 
+// MaxSegmentSize is the size of the largest packets WriteToUDPAddrPortGSO
+// writes.
+const MaxSegmentSize = 65535
+
 type PacketConn struct {
 	*net.UDPConn // TODO: hide methods?
 }
@@ -19,16 +23,23 @@ func ListenAddrPort(laddr netip.AddrPort) (*PacketConn, error) {
 	pconn := &PacketConn{uconn}
 	pconn.setGRO(true)
 	pconn.setDontFragment(true)
+	pconn.setRecvTOS(true)
 	return pconn, nil
 }
 
-func (c *PacketConn) ReadFromUDPAddrPortGRO(b []byte) (int, int, netip.AddrPort, error) {
+// ReadFromUDPAddrPortGRO reads one or more packets of the same size into b. It
+// returns the number of bytes read, the size of the packets, which the last
+// packet may be shorter than, and the ECN codepoint the packets were marked
+// with.
+func (c *PacketConn) ReadFromUDPAddrPortGRO(b []byte) (int, int, ECN, netip.AddrPort, error) {
 	return c.readFromUDPAddrPortGRO(b)
 }
 
-func (c *PacketConn) WriteToUDPAddrPortGSO(b []byte, ss int, raddr netip.AddrPort) (int, error) {
-	if ss < 1200 || 65535 < ss {
+// WriteToUDPAddrPortGSO writes b as packets of ss bytes, the last of which may
+// be shorter, and marks them with the ECN codepoint ecn.
+func (c *PacketConn) WriteToUDPAddrPortGSO(b []byte, ss int, ecn ECN, raddr netip.AddrPort) (int, error) {
+	if ss < 1200 || MaxSegmentSize < ss {
 		return 0, errors.New("bad segment size")
 	}
-	return c.writeToUDPAddrPortGSO(b, ss, raddr)
+	return c.writeToUDPAddrPortGSO(b, ss, ecn&ecnMask, raddr)
 }
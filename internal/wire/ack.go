@@ -2,6 +2,7 @@ package wire
 
 import (
 	"errors"
+	"io"
 	"time"
 )
 
@@ -13,12 +14,22 @@ type Ack struct {
 	Delay time.Duration
 
 	Ranges PacketNumberRanges
+
+	// ECN are the counts of the packets received with each ECN codepoint,
+	// zero if the frame carries none.
+	ECN ECNCounts
+}
+
+// ECNCounts are the counts of the packets received with the ECT(0), ECT(1) and
+// CE codepoints, see RFC 9000, Section 19.3.2.
+type ECNCounts struct {
+	ECT0, ECT1, CE int64
 }
 
-func IsAck(t byte) bool { return t == 0b00000010 }
+func IsAck(t byte) bool { return t&^1 == 0b00000010 }
 
 func DecodeAck(r *Reader, limit int) (Ack, error) {
-	r.ReadByte()
+	t, _ := r.ReadByte()
 
 	max, err := DecodeVarint(r)
 	if err != nil {
@@ -59,9 +70,19 @@ func DecodeAck(r *Reader, limit int) (Ack, error) {
 		}
 	}
 
+	var ecn ECNCounts
+	if t&1 != 0 {
+		for _, x := range []*int64{&ecn.ECT0, &ecn.ECT1, &ecn.CE} {
+			if *x, err = DecodeVarint(r); err != nil {
+				return Ack{}, err
+			}
+		}
+	}
+
 	return Ack{
 		Delay:  delay,
 		Ranges: ranges,
+		ECN:    ecn,
 	}, nil
 }
 
@@ -76,8 +97,44 @@ func decodeDiff(r *Reader, max int64) (int64, error) {
 	return max - gap, nil
 }
 
+// AckMaxRangeCount returns how many of the greatest ranges of a fit in an ACK
+// frame of at most n bytes, or 0 if not even one does.
+func AckMaxRangeCount(n int, a Ack) int {
+	if len(a.Ranges) == 0 {
+		return 0
+	}
+	size := 1 + VarintLen(int64(a.Ranges[0].Max)) + VarintLen(a.Delay.Microseconds()) + VarintLen(int64(a.Ranges[0].Max-a.Ranges[0].Min))
+	if a.ECN != (ECNCounts{}) {
+		size += VarintLen(a.ECN.ECT0) + VarintLen(a.ECN.ECT1) + VarintLen(a.ECN.CE)
+	}
+	for i := range a.Ranges {
+		if i > 0 {
+			size += VarintLen(int64(a.Ranges[i-1].Min-a.Ranges[i].Max-2)) + VarintLen(int64(a.Ranges[i].Max-a.Ranges[i].Min))
+		}
+		if size+VarintLen(int64(i)) > n {
+			return i
+		}
+	}
+	return len(a.Ranges)
+}
+
+// Encode writes as many of the greatest ranges of a as fit in w, dropping the
+// least ones, which the peer is the least likely to still wait for.
 func (a Ack) Encode(w *Writer) error {
-	if err := w.WriteByte(0b00000010); err != nil {
+	if len(a.Ranges) == 0 {
+		return errors.New("no ranges to acknowledge")
+	}
+	n := AckMaxRangeCount(w.Remaining(), a)
+	if n == 0 {
+		return io.ErrShortWrite
+	}
+	a.Ranges = a.Ranges[:n]
+
+	t := byte(0b00000010)
+	if a.ECN != (ECNCounts{}) {
+		t |= 1
+	}
+	if err := w.WriteByte(t); err != nil {
 		return err
 	}
 	if err := EncodeVarint(w, int64(a.Ranges[0].Max)); err != nil {
@@ -102,6 +159,13 @@ func (a Ack) Encode(w *Writer) error {
 		}
 		prevMin = r.Min
 	}
+	if t&1 != 0 {
+		for _, x := range []int64{a.ECN.ECT0, a.ECN.ECT1, a.ECN.CE} {
+			if err := EncodeVarint(w, x); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,87 @@
+package wire
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+var ackTests = []struct {
+	ack  Ack
+	want string
+}{
+	{Ack{Ranges: PacketNumberRanges{{8, 10}}}, "\x02\x28\x00\x08\x00"},
+	{Ack{Ranges: PacketNumberRanges{{8, 10}}, ECN: ECNCounts{ECT0: 3, CE: 1}}, "\x03\x28\x00\x08\x00\x0c\x00\x04"},
+}
+
+func TestAckEncodeDecode(t *testing.T) {
+	for _, test := range ackTests {
+		buf := make([]byte, 100)
+		w := NewWriter(buf)
+		if err := test.ack.Encode(w); err != nil {
+			t.Fatalf("err = %v, want %v", err, error(nil))
+		}
+		if got := buf[:w.Len()]; !bytes.Equal(got, []byte(test.want)) {
+			t.Fatalf("encoded %+v = %x, want %x", test.ack, got, test.want)
+		}
+
+		ack, err := DecodeAck(NewReader([]byte(test.want)), math.MaxInt)
+		if err != nil {
+			t.Fatalf("err = %v, want %v", err, error(nil))
+		}
+		if !reflect.DeepEqual(ack, test.ack) {
+			t.Fatalf("ack = %+v, want %+v", ack, test.ack)
+		}
+	}
+}
+
+func TestAckTruncation(t *testing.T) {
+	// Ranges of 1 packet, 2 apart: each takes 2 bytes.
+	var ranges PacketNumberRanges
+	for pn := PacketNumber(1000); pn > 0; pn -= 2 {
+		ranges = append(ranges, PacketNumberRange{pn, pn})
+	}
+	ack := Ack{Ranges: ranges, ECN: ECNCounts{ECT0: 1000}}
+
+	for _, test := range []struct {
+		n, ranges int
+	}{
+		{0, 0},
+		{9, 0},    // type, max, delay, first range, count and ECN counts take 10 bytes
+		{10, 1},   // just the first range
+		{11, 1},   // half a range more
+		{12, 2},   // one range more
+		{136, 64}, // the count takes 1 byte up to 64 ranges
+		{138, 64}, // and 2 bytes afterwards
+		{139, 65},
+		{10000, len(ranges)},
+	} {
+		if got := AckMaxRangeCount(test.n, ack); got != test.ranges {
+			t.Errorf("AckMaxRangeCount(%d) = %d, want %d", test.n, got, test.ranges)
+		}
+
+		buf := make([]byte, test.n)
+		w := NewWriter(buf)
+		err := ack.Encode(w)
+		if test.ranges == 0 {
+			if err == nil {
+				t.Errorf("n = %d: err = nil, want non-nil", test.n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("n = %d: err = %v, want %v", test.n, err, error(nil))
+		}
+
+		got, err := DecodeAck(NewReader(buf[:w.Len()]), math.MaxInt)
+		if err != nil {
+			t.Fatalf("n = %d: err = %v, want %v", test.n, err, error(nil))
+		}
+		want := ack
+		want.Ranges = ranges[:test.ranges]
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("n = %d: ack = %+v, want %+v", test.n, got, want)
+		}
+	}
+}
@@ -1,9 +1,53 @@
 package wire
 
-type Close struct{}
+type Close struct {
+	// Application is set if the connection was closed by the application,
+	// rather than the transport.
+	Application bool
 
-func IsClose(t byte) bool { return t == 0b11111111 }
+	Code   int64 // 0 ≤ Code ≤ MaxVarint
+	Reason []byte
+}
+
+func IsClose(t byte) bool { return t&^0b1 == 0b11111110 }
+
+func DecodeClose(r *Reader) (Close, error) {
+	t, _ := r.ReadByte()
+
+	code, err := DecodeVarint(r)
+	if err != nil {
+		return Close{}, err
+	}
+
+	reason, err := DecodeLengthPrefixedBytes(r)
+	if err != nil {
+		return Close{}, err
+	}
+
+	return Close{
+		Application: t&0b1 == 0,
+		Code:        code,
+		Reason:      reason,
+	}, nil
+}
+
+func (c Close) Encode(w *Writer) error {
+	t := byte(0b11111111)
+	if c.Application {
+		t &^= 0b1
+	}
+	if err := w.WriteByte(t); err != nil {
+		return err
+	}
+	if err := EncodeVarint(w, c.Code); err != nil {
+		return err
+	}
+	return EncodeLengthPrefixedBytes(w, c.Reason)
+}
 
-func (Close) Encode(w *Writer) error {
-	return w.WriteByte(0b11111111)
+// CloseMaxReasonLen returns how many bytes of a reason of length reasonLen fit
+// in a CLOSE frame of at most n bytes.
+func CloseMaxReasonLen(n int, code int64, reasonLen int) int {
+	overhead := 1 + VarintLen(code) + VarintLen(int64(reasonLen))
+	return max(min(n-overhead, reasonLen), 0)
 }
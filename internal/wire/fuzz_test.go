@@ -15,8 +15,12 @@ var fuzzTests = []func(*testing.T, []byte){
 	func(t *testing.T, data []byte) {
 		fuzzHelper(t, data, func(r *Reader) (Ack, error) { return DecodeAck(r, math.MaxInt) })
 	},
+	fuzzAckTruncation,
 	func(t *testing.T, data []byte) { fuzzHelper(t, data, DecodePing) },
 	func(t *testing.T, data []byte) { fuzzHelper(t, data, DecodeMaxStreamData) },
+	func(t *testing.T, data []byte) { fuzzHelper(t, data, DecodeMaxStreams) },
+	func(t *testing.T, data []byte) { fuzzHelper(t, data, DecodeClose) },
+	fuzzTransportParameters,
 }
 
 func Fuzz(f *testing.F) {
@@ -49,3 +53,71 @@ func fuzzHelper[T interface{ Encode(*Writer) error }](t *testing.T, data []byte,
 		t.Fatalf("x = %#v, y = %#v", x, y)
 	}
 }
+
+// Transport parameters extend to the end of the buffer, so unlike frames they
+// can't be decoded from a buffer with trailing bytes.
+func fuzzTransportParameters(t *testing.T, data []byte) {
+	x, err := DecodeTransportParameters(NewReader(data))
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, len(data))
+	w := NewWriter(buf)
+	if err := x.Encode(w); err != nil {
+		t.Fatal(err)
+	}
+
+	y, err := DecodeTransportParameters(NewReader(buf[:w.Len()]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(x, y) {
+		t.Fatalf("x = %#v, y = %#v", x, y)
+	}
+}
+
+// An ACK frame encoded into a buffer too small for it must keep as many of the
+// greatest ranges as fit.
+func fuzzAckTruncation(t *testing.T, data []byte) {
+	x, err := DecodeAck(NewReader(data), math.MaxInt)
+	if err != nil {
+		return
+	}
+
+	for n := 0; n < len(data); n++ {
+		buf := make([]byte, n)
+		w := NewWriter(buf)
+		if err := x.Encode(w); err != nil {
+			if AckMaxRangeCount(n, x) != 0 {
+				t.Fatalf("n = %d: err = %v, want nil", n, err)
+			}
+			continue
+		}
+
+		y, err := DecodeAck(NewReader(buf[:w.Len()]), math.MaxInt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		k := len(y.Ranges)
+		if k != AckMaxRangeCount(n, x) || !reflect.DeepEqual(y.Ranges, x.Ranges[:k]) || y.Delay != x.Delay || y.ECN != x.ECN {
+			t.Fatalf("n = %d: x = %#v, y = %#v", n, x, y)
+		}
+
+		// One more range wouldn't fit.
+		if k < len(x.Ranges) {
+			z := x
+			z.Ranges = x.Ranges[:k+1]
+			buf := make([]byte, len(data))
+			w := NewWriter(buf)
+			if err := z.Encode(w); err != nil {
+				t.Fatal(err)
+			}
+			if w.Len() <= n {
+				t.Fatalf("n = %d: %d ranges were dropped, but %d fit in %d bytes", n, len(x.Ranges)-k, k+1, w.Len())
+			}
+		}
+	}
+}
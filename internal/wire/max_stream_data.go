@@ -1,26 +1,45 @@
 package wire
 
-type MaxStreamData int64 // must be between 0 and MaxVarint incl.
+type MaxStreamData struct {
+	ID  int64 // 0 ≤ ID ≤ MaxVarint
+	Off int64 // 0 ≤ Off ≤ MaxVarint
+}
 
 func IsMaxStreamData(t byte) bool { return t == 0b10000100 }
 
 func DecodeMaxStreamData(r *Reader) (MaxStreamData, error) {
 	r.ReadByte()
 
+	id, err := DecodeVarint(r)
+	if err != nil {
+		return MaxStreamData{}, err
+	}
+
 	off, err := DecodeVarint(r)
 	if err != nil {
-		return MaxStreamData(0), err
+		return MaxStreamData{}, err
 	}
 
-	return MaxStreamData(off), nil
+	return MaxStreamData{
+		ID:  id,
+		Off: off,
+	}, nil
 }
 
-func (off MaxStreamData) Encode(w *Writer) error {
+func (m MaxStreamData) Encode(w *Writer) error {
 	if err := w.WriteByte(0b10000100); err != nil {
 		return err
 	}
-	if err := EncodeVarint(w, int64(off)); err != nil {
+	if err := EncodeVarint(w, m.ID); err != nil {
+		return err
+	}
+	if err := EncodeVarint(w, m.Off); err != nil {
 		return err
 	}
 	return nil
 }
+
+// Len returns the encoded size of m.
+func (m MaxStreamData) Len() int {
+	return 1 + VarintLen(m.ID) + VarintLen(m.Off)
+}
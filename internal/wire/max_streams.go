@@ -0,0 +1,37 @@
+package wire
+
+// MaxStreams raises the number of streams the recipient may open over the
+// lifetime of the connection.
+type MaxStreams struct {
+	Max int64 // 0 ≤ Max ≤ MaxVarint
+}
+
+func IsMaxStreams(t byte) bool { return t == 0b10000101 }
+
+func DecodeMaxStreams(r *Reader) (MaxStreams, error) {
+	r.ReadByte()
+
+	max, err := DecodeVarint(r)
+	if err != nil {
+		return MaxStreams{}, err
+	}
+
+	return MaxStreams{
+		Max: max,
+	}, nil
+}
+
+func (m MaxStreams) Encode(w *Writer) error {
+	if err := w.WriteByte(0b10000101); err != nil {
+		return err
+	}
+	if err := EncodeVarint(w, m.Max); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Len returns the encoded size of m.
+func (m MaxStreams) Len() int {
+	return 1 + VarintLen(m.Max)
+}
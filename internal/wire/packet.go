@@ -1,7 +1,24 @@
 package wire
 
 const (
-	DataPacket      = 0x00
-	HandshakePacket = 0x80
-	RetryPacket     = 0xc0
+	DataPacket        = 0x00
+	NegotiationPacket = 0x40
+	HandshakePacket   = 0x80
+	RetryPacket       = 0xc0
 )
+
+// KeyPhase is the bit of the first byte of a data packet that tells which keys
+// the packet is protected with.
+const KeyPhase = 0x20
+
+// The header protection of a data packet is computed from a sample of the
+// ciphertext following the packet number. Every packet has at least
+// HeaderSampleSize bytes of ciphertext: the AEAD tag.
+const (
+	HeaderSampleOffset = 12
+	HeaderSampleSize   = 16
+)
+
+// ConnIDMask masks out the bits of the first byte of a packet that are not part
+// of the connection ID.
+const ConnIDMask = 0xe0
@@ -1,6 +1,9 @@
 package wire
 
-import "math"
+import (
+	"math"
+	"sort"
+)
 
 const MaxPacketNumber = MaxVarint
 
@@ -23,13 +26,15 @@ func (ranges PacketNumberRanges) Max() PacketNumber {
 	return ranges[0].Max
 }
 
+// search returns the index of the greatest range whose Min is at most pn, or
+// len(ranges) if there's none.
+func (ranges PacketNumberRanges) search(pn PacketNumber) int {
+	return sort.Search(len(ranges), func(i int) bool { return ranges[i].Min <= pn })
+}
+
 func (ranges PacketNumberRanges) Contains(pn PacketNumber) bool {
-	for _, r := range ranges {
-		if r.Contains(pn) {
-			return true
-		}
-	}
-	return false
+	i := ranges.search(pn)
+	return i < len(ranges) && ranges[i].Contains(pn)
 }
 
 // TrimLesser returns a slice of ranges with ranges lesser than pn removed.
@@ -41,3 +46,51 @@ func (ranges PacketNumberRanges) TrimLesser(pn PacketNumber) PacketNumberRanges
 	}
 	return ranges
 }
+
+// Remove returns ranges with the packet numbers in r removed. Like append, it
+// may modify ranges in place.
+func (ranges PacketNumberRanges) Remove(r PacketNumberRange) PacketNumberRanges {
+	// ranges[i:j] overlap r
+	i := ranges.search(r.Max)
+	j := sort.Search(len(ranges), func(i int) bool { return ranges[i].Max < r.Min })
+	if i >= j {
+		return ranges
+	}
+
+	// What's left of ranges[i] above r and of ranges[j-1] below it
+	var rest PacketNumberRanges
+	if ranges[i].Max > r.Max {
+		rest = append(rest, PacketNumberRange{r.Max + 1, ranges[i].Max})
+	}
+	if ranges[j-1].Min < r.Min {
+		rest = append(rest, PacketNumberRange{ranges[j-1].Min, r.Min - 1})
+	}
+	return append(ranges[:i], append(rest, ranges[j:]...)...)
+}
+
+// Insert returns ranges with pn added. Like append, it may modify ranges in
+// place. It takes logarithmic time, unless pn starts a new range, which moves
+// the ranges lesser than it.
+func (ranges PacketNumberRanges) Insert(pn PacketNumber) PacketNumberRanges {
+	i := ranges.search(pn)
+	if i < len(ranges) && ranges[i].Contains(pn) {
+		return ranges
+	}
+
+	below := i < len(ranges) && ranges[i].Max+1 == pn
+	above := i > 0 && ranges[i-1].Min-1 == pn
+	switch {
+	case below && above:
+		ranges[i-1].Min = ranges[i].Min
+		return append(ranges[:i], ranges[i+1:]...)
+	case below:
+		ranges[i].Max = pn
+	case above:
+		ranges[i-1].Min = pn
+	default:
+		ranges = append(ranges, PacketNumberRange{})
+		copy(ranges[i+1:], ranges[i:])
+		ranges[i] = PacketNumberRange{pn, pn}
+	}
+	return ranges
+}
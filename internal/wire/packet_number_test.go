@@ -3,9 +3,105 @@ package wire
 import (
 	"fmt"
 	"math/rand"
+	"reflect"
 	"testing"
 )
 
+func TestPacketNumberRangesInsert(t *testing.T) {
+	var ranges PacketNumberRanges
+	for _, test := range []struct {
+		pn   PacketNumber
+		want PacketNumberRanges
+	}{
+		{5, PacketNumberRanges{{5, 5}}},
+		{6, PacketNumberRanges{{5, 6}}},                   // in order
+		{10, PacketNumberRanges{{10, 10}, {5, 6}}},        // a gap
+		{1, PacketNumberRanges{{10, 10}, {5, 6}, {1, 1}}}, // reordered
+		{8, PacketNumberRanges{{10, 10}, {8, 8}, {5, 6}, {1, 1}}},
+		{6, PacketNumberRanges{{10, 10}, {8, 8}, {5, 6}, {1, 1}}}, // duplicate
+		{4, PacketNumberRanges{{10, 10}, {8, 8}, {4, 6}, {1, 1}}}, // adjacent to the range above
+		{9, PacketNumberRanges{{8, 10}, {4, 6}, {1, 1}}},          // fills a gap
+		{7, PacketNumberRanges{{4, 10}, {1, 1}}},
+	} {
+		ranges = ranges.Insert(test.pn)
+		if !reflect.DeepEqual(ranges, test.want) {
+			t.Fatalf("after inserting %d, ranges = %v, want %v", test.pn, ranges, test.want)
+		}
+	}
+}
+
+func TestPacketNumberRangesInsertRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+
+	var ranges PacketNumberRanges
+	inserted := make(map[PacketNumber]bool)
+	for i := 0; i < 1000; i++ {
+		pn := PacketNumber(r.Int63n(2000))
+		ranges = ranges.Insert(pn)
+		inserted[pn] = true
+	}
+
+	for i := range ranges {
+		if ranges[i].Min > ranges[i].Max || i > 0 && ranges[i-1].Min <= ranges[i].Max+1 {
+			t.Fatalf("ranges %v aren't sorted, non-adjacent and disjoint", ranges)
+		}
+	}
+	for pn := PacketNumber(-1); pn <= 2000; pn++ {
+		if ranges.Contains(pn) != inserted[pn] {
+			t.Fatalf("Contains(%d) = %v, want %v", pn, ranges.Contains(pn), inserted[pn])
+		}
+	}
+}
+
+func TestPacketNumberRangesRemove(t *testing.T) {
+	for _, test := range []struct {
+		r    PacketNumberRange
+		want PacketNumberRanges
+	}{
+		{PacketNumberRange{20, 30}, PacketNumberRanges{{15, 16}, {8, 10}, {4, 6}, {1, 1}}}, // none
+		{PacketNumberRange{8, 10}, PacketNumberRanges{{15, 16}, {4, 6}, {1, 1}}},           // a whole range
+		{PacketNumberRange{9, 9}, PacketNumberRanges{{15, 16}, {10, 10}, {8, 8}, {4, 6}, {1, 1}}},
+		{PacketNumberRange{5, 15}, PacketNumberRanges{{16, 16}, {4, 4}, {1, 1}}}, // parts of several
+		{PacketNumberRange{0, 100}, PacketNumberRanges{}},
+	} {
+		ranges := PacketNumberRanges{{15, 16}, {8, 10}, {4, 6}, {1, 1}}
+		if got := ranges.Remove(test.r); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Remove(%v) = %v, want %v", test.r, got, test.want)
+		}
+	}
+}
+
+func TestPacketNumberRangesRemoveRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+
+	var ranges PacketNumberRanges
+	inserted := make(map[PacketNumber]bool)
+	for i := 0; i < 1000; i++ {
+		pn := PacketNumber(r.Int63n(2000))
+		ranges = ranges.Insert(pn)
+		inserted[pn] = true
+	}
+	for i := 0; i < 50; i++ {
+		min := PacketNumber(r.Int63n(2000))
+		max := min + PacketNumber(r.Int63n(50))
+		ranges = ranges.Remove(PacketNumberRange{min, max})
+		for pn := min; pn <= max; pn++ {
+			delete(inserted, pn)
+		}
+	}
+
+	for i := range ranges {
+		if ranges[i].Min > ranges[i].Max || i > 0 && ranges[i-1].Min <= ranges[i].Max+1 {
+			t.Fatalf("ranges %v aren't sorted, non-adjacent and disjoint", ranges)
+		}
+	}
+	for pn := PacketNumber(-1); pn <= 2100; pn++ {
+		if ranges.Contains(pn) != inserted[pn] {
+			t.Fatalf("Contains(%d) = %v, want %v", pn, ranges.Contains(pn), inserted[pn])
+		}
+	}
+}
+
 func BenchmarkPacketNumberRangesContains(b *testing.B) {
 	r := rand.New(rand.NewSource(42))
 
@@ -6,15 +6,22 @@ import (
 )
 
 type Stream struct {
+	ID   int64  // 0 ≤ ID ≤ MaxVarint
 	Off  int64  // 0 ≤ Off ≤ MaxVarint
-	Data []byte // must be non-empty
+	Data []byte // must be non-empty, unless Fin is set
+	Fin  bool   // Off+len(Data) is the final size of the stream
 }
 
-func IsStream(t byte) bool { return t&^0b1 == 0b10000010 }
+func IsStream(t byte) bool { return t&^0b101 == 0b10000010 }
 
 func DecodeStream(r *Reader) (Stream, error) {
 	t, _ := r.ReadByte()
 
+	id, err := DecodeVarint(r)
+	if err != nil {
+		return Stream{}, err
+	}
+
 	off, err := DecodeVarint(r)
 	if err != nil {
 		return Stream{}, err
@@ -33,7 +40,8 @@ func DecodeStream(r *Reader) (Stream, error) {
 	} else {
 		dataLen = int64(r.Remaining())
 	}
-	if dataLen == 0 {
+	fin := t&0b100 != 0
+	if dataLen == 0 && !fin {
 		return Stream{}, errors.New("empty STREAM")
 	}
 	if off+int64(dataLen) > MaxVarint {
@@ -46,8 +54,10 @@ func DecodeStream(r *Reader) (Stream, error) {
 	}
 
 	return Stream{
+		ID:   id,
 		Off:  int64(off),
 		Data: data,
+		Fin:  fin,
 	}, nil
 }
 
@@ -56,9 +66,15 @@ func (s Stream) Encode(w *Writer, explicitLen bool) error {
 	if explicitLen {
 		t |= 0b1
 	}
+	if s.Fin {
+		t |= 0b100
+	}
 	if err := w.WriteByte(t); err != nil {
 		return err
 	}
+	if err := EncodeVarint(w, s.ID); err != nil {
+		return err
+	}
 	if err := EncodeVarint(w, s.Off); err != nil {
 		return err
 	}
@@ -71,17 +87,19 @@ func (s Stream) Encode(w *Writer, explicitLen bool) error {
 	return err
 }
 
-// n, off and dataLen must be non-negative.
-func StreamMaxDataLen(n int, off int64, dataLen int) (int, bool) {
-	overhead := 1 + VarintLen(off)
+// StreamMaxDataLen returns how many bytes of data of a STREAM frame fit in n
+// bytes and whether the frame needs an explicit length. n, id, off and dataLen
+// must be non-negative.
+func StreamMaxDataLen(n int, id, off int64, dataLen int) (int, bool) {
+	overhead := 1 + VarintLen(id) + VarintLen(off)
 	if n < overhead+1 {
-		// Too small to fit the offset and a single byte of data.
+		// Too small to fit the stream ID, offset and a single byte of
+		// data.
 		return 0, false
 	}
 
 	if n <= overhead+dataLen {
-		// The data is at least n-1-VarintLen(off) big. Don't write the
-		// length.
+		// The data is at least n-overhead big. Don't write the length.
 		return n - overhead, false
 	}
 
@@ -91,3 +109,9 @@ func StreamMaxDataLen(n int, off int64, dataLen int) (int, bool) {
 	// the length itself.
 	return min(n-overhead-VarintLen(int64(min(n-overhead-1, dataLen))), dataLen), true
 }
+
+// StreamFinLen returns the size of a STREAM frame that carries no data, only
+// the final size, when encoded with explicit length.
+func StreamFinLen(id, off int64) int {
+	return 1 + VarintLen(id) + VarintLen(off) + 1
+}
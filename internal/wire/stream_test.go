@@ -7,17 +7,19 @@ import (
 )
 
 var streamTests = []struct {
+	id          int64
 	off         int64
 	dataLen     int
 	n           int
-	explicitLen bool // ignored if n = 0; must be set if dataLen < n-VarintLen(off)
+	explicitLen bool // ignored if n = 0; must be set if dataLen < n-VarintLen(id)-VarintLen(off)
 	want        string
 }{
-	{10000000, 10, 0, false, ""},                                                // too little to fit
-	{999, 999, 998, false, "\x82\x9d\x0f" + strings.Repeat("\x00", 998)},        // big blob at an offset that encodes to a two byte varint, with implicit length
-	{999, 997, 996, true, "\x83\x9d\x0f\x91\x0f" + strings.Repeat("\x00", 996)}, // big blob at an offset that encodes to a two byte varint, with explicitLen
-	{MaxVarint - 1, 1, 1, false, "\x82\xfb\xff\xff\xff\xff\xff\xff\xff\x00"},    // one byte at the end of stream with explicitLen
-	{MaxVarint - 1, 1, 1, true, "\x83\xfb\xff\xff\xff\xff\xff\xff\xff\x04\x00"}, // one byte at the end of stream with implicit length
+	{0, 10000000, 10, 0, false, ""},                                                    // too little to fit
+	{0, 999, 999, 997, false, "\x82\x00\x9d\x0f" + strings.Repeat("\x00", 997)},        // big blob at an offset that encodes to a two byte varint, with implicit length
+	{0, 999, 995, 995, true, "\x83\x00\x9d\x0f\x8d\x0f" + strings.Repeat("\x00", 995)}, // big blob at an offset that encodes to a two byte varint, with explicitLen
+	{0, MaxVarint - 1, 1, 1, false, "\x82\x00\xfb\xff\xff\xff\xff\xff\xff\xff\x00"},    // one byte at the end of stream with implicit length
+	{0, MaxVarint - 1, 1, 1, true, "\x83\x00\xfb\xff\xff\xff\xff\xff\xff\xff\x04\x00"}, // one byte at the end of stream with explicitLen
+	{5, 0, 3, 3, false, "\x82\x14\x00\x00\x00\x00"},                                    // non-default stream
 }
 
 func TestStreamEncodeDecode(t *testing.T) {
@@ -31,6 +33,7 @@ func TestStreamEncodeDecode(t *testing.T) {
 
 			w := NewWriter(buf)
 			if err := (&Stream{
+				ID:   test.id,
 				Off:  test.off,
 				Data: make([]byte, test.n),
 			}).Encode(w, test.explicitLen); err != nil {
@@ -48,6 +51,9 @@ func TestStreamEncodeDecode(t *testing.T) {
 			if err != nil {
 				t.Fatalf("err = %v, want %v", err, error(nil))
 			}
+			if s.ID != test.id {
+				t.Fatalf("s.ID = %d, want %d", s.ID, test.id)
+			}
 			if s.Off != test.off {
 				t.Fatalf("s.Off = %d, want %d", s.Off, test.off)
 			}
@@ -61,10 +67,46 @@ func TestStreamEncodeDecode(t *testing.T) {
 	}
 }
 
+func TestStreamFinEncodeDecode(t *testing.T) {
+	for i, test := range []struct {
+		s    Stream
+		want string
+	}{
+		{Stream{ID: 1, Off: 7, Fin: true}, "\x87\x04\x1c\x00"},
+		{Stream{ID: 1, Off: 7, Data: []byte("x"), Fin: true}, "\x87\x04\x1c\x04x"},
+	} {
+		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
+			buf := make([]byte, 100)
+
+			w := NewWriter(buf)
+			if err := test.s.Encode(w, true); err != nil {
+				t.Fatalf("err = %v, want %v", err, error(nil))
+			}
+
+			buf = buf[:w.Len()]
+
+			if string(buf) != test.want {
+				t.Fatalf("buf = %x, want %x", buf, test.want)
+			}
+			if len(test.s.Data) == 0 && len(buf) != StreamFinLen(test.s.ID, test.s.Off) {
+				t.Fatalf("len(buf) = %d, want %d", len(buf), StreamFinLen(test.s.ID, test.s.Off))
+			}
+
+			s, err := DecodeStream(NewReader(buf))
+			if err != nil {
+				t.Fatalf("err = %v, want %v", err, error(nil))
+			}
+			if s.ID != test.s.ID || s.Off != test.s.Off || string(s.Data) != string(test.s.Data) || !s.Fin {
+				t.Fatalf("s = %+v, want %+v", s, test.s)
+			}
+		})
+	}
+}
+
 func TestMaxStreamDataLen(t *testing.T) {
 	for i, test := range streamTests {
 		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
-			n, explicitLen := StreamMaxDataLen(len(test.want), test.off, test.dataLen)
+			n, explicitLen := StreamMaxDataLen(len(test.want), test.id, test.off, test.dataLen)
 			if n != test.n {
 				t.Errorf("n = %d, want %d", n, test.n)
 			}
@@ -0,0 +1,187 @@
+package wire
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// TransportParameters are exchanged by the peers during the handshake.
+// Durations are encoded in milliseconds, zero values are omitted.
+//
+// MaxPacketSize, MaxAckDelay, InitialStreamWindow, MsgWindow and MaxStreams
+// describe the sender of the parameters: the largest packet it accepts, how long
+// it may delay acknowledgements, the receive window each new stream starts with,
+// the size of the largest message it accepts, and how many streams the recipient
+// may open until the sender raises the limit with MAX_STREAMS.
+//
+// Protocols lists the application protocols the initiator offers, in the order
+// of preference, and the one protocol the responder selected among them.
+//
+// Parameters are encoded as a sequence of parameter ID, value length and value
+// triplets, to allow skipping parameters the recipient does not understand.
+type TransportParameters struct {
+	MaxIdleTimeout      time.Duration
+	KeepAlivePeriod     time.Duration
+	MaxPacketSize       int
+	MaxAckDelay         time.Duration
+	InitialStreamWindow int64
+	MsgWindow           int64
+	MaxStreams          int64
+	Protocols           []string
+}
+
+const (
+	maxIdleTimeoutParameterID      = 0x00
+	keepAlivePeriodParameterID     = 0x01
+	maxPacketSizeParameterID       = 0x02
+	maxAckDelayParameterID         = 0x03
+	initialStreamWindowParameterID = 0x04
+	msgWindowParameterID           = 0x05
+	protocolsParameterID           = 0x06
+	maxStreamsParameterID          = 0x07
+)
+
+func DecodeTransportParameters(r *Reader) (TransportParameters, error) {
+	var params TransportParameters
+	for r.Remaining() > 0 {
+		id, err := DecodeVarint(r)
+		if err != nil {
+			return TransportParameters{}, err
+		}
+		value, err := DecodeLengthPrefixedBytes(r)
+		if err != nil {
+			return TransportParameters{}, err
+		}
+
+		switch id {
+		case maxIdleTimeoutParameterID:
+			params.MaxIdleTimeout, err = decodeDurationParameter(value)
+		case keepAlivePeriodParameterID:
+			params.KeepAlivePeriod, err = decodeDurationParameter(value)
+		case maxPacketSizeParameterID:
+			var x int64
+			x, err = decodeIntParameter(value)
+			params.MaxPacketSize = int(x)
+			if err == nil && int64(params.MaxPacketSize) != x {
+				err = errors.New("max packet size overflows")
+			}
+		case maxAckDelayParameterID:
+			params.MaxAckDelay, err = decodeDurationParameter(value)
+		case initialStreamWindowParameterID:
+			params.InitialStreamWindow, err = decodeIntParameter(value)
+		case msgWindowParameterID:
+			params.MsgWindow, err = decodeIntParameter(value)
+		case protocolsParameterID:
+			params.Protocols, err = decodeProtocolsParameter(value)
+		case maxStreamsParameterID:
+			params.MaxStreams, err = decodeIntParameter(value)
+		}
+		if err != nil {
+			return TransportParameters{}, err
+		}
+	}
+	return params, nil
+}
+
+func (params TransportParameters) Encode(w *Writer) error {
+	if err := encodeDurationParameter(w, maxIdleTimeoutParameterID, params.MaxIdleTimeout); err != nil {
+		return err
+	}
+	if err := encodeDurationParameter(w, keepAlivePeriodParameterID, params.KeepAlivePeriod); err != nil {
+		return err
+	}
+	if err := encodeIntParameter(w, maxPacketSizeParameterID, int64(params.MaxPacketSize)); err != nil {
+		return err
+	}
+	if err := encodeDurationParameter(w, maxAckDelayParameterID, params.MaxAckDelay); err != nil {
+		return err
+	}
+	if err := encodeIntParameter(w, initialStreamWindowParameterID, params.InitialStreamWindow); err != nil {
+		return err
+	}
+	if err := encodeIntParameter(w, msgWindowParameterID, params.MsgWindow); err != nil {
+		return err
+	}
+	if err := encodeProtocolsParameter(w, protocolsParameterID, params.Protocols); err != nil {
+		return err
+	}
+	if err := encodeIntParameter(w, maxStreamsParameterID, params.MaxStreams); err != nil {
+		return err
+	}
+	return nil
+}
+
+func decodeIntParameter(value []byte) (int64, error) {
+	r := NewReader(value)
+	x, err := DecodeVarint(r)
+	if err != nil {
+		return 0, err
+	}
+	if r.Remaining() != 0 {
+		return 0, errors.New("trailing bytes in parameter value")
+	}
+	return x, nil
+}
+
+func decodeDurationParameter(value []byte) (time.Duration, error) {
+	ms, err := decodeIntParameter(value)
+	if err != nil {
+		return 0, err
+	}
+	if ms > math.MaxInt64/int64(time.Millisecond) {
+		return 0, errors.New("duration overflows")
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func encodeDurationParameter(w *Writer, id int64, d time.Duration) error {
+	return encodeIntParameter(w, id, d.Milliseconds())
+}
+
+func encodeIntParameter(w *Writer, id int64, x int64) error {
+	if x <= 0 {
+		return nil
+	}
+	if err := EncodeVarint(w, id); err != nil {
+		return err
+	}
+	if err := EncodeVarint(w, int64(VarintLen(x))); err != nil {
+		return err
+	}
+	return EncodeVarint(w, x)
+}
+
+func decodeProtocolsParameter(value []byte) ([]string, error) {
+	var protocols []string
+	for r := NewReader(value); r.Remaining() > 0; {
+		protocol, err := DecodeLengthPrefixedBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		protocols = append(protocols, string(protocol))
+	}
+	return protocols, nil
+}
+
+func encodeProtocolsParameter(w *Writer, id int64, protocols []string) error {
+	if len(protocols) == 0 {
+		return nil
+	}
+	n := 0
+	for _, protocol := range protocols {
+		n += VarintLen(int64(len(protocol))) + len(protocol)
+	}
+	if err := EncodeVarint(w, id); err != nil {
+		return err
+	}
+	if err := EncodeVarint(w, int64(n)); err != nil {
+		return err
+	}
+	for _, protocol := range protocols {
+		if err := EncodeLengthPrefixedBytes(w, []byte(protocol)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
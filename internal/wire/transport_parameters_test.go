@@ -0,0 +1,38 @@
+package wire
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTransportParametersEncodeDecode(t *testing.T) {
+	want := TransportParameters{
+		MaxIdleTimeout:      30 * time.Second,
+		KeepAlivePeriod:     10 * time.Second,
+		MaxPacketSize:       1452,
+		MaxAckDelay:         25 * time.Millisecond,
+		InitialStreamWindow: 1 << 20,
+		MsgWindow:           65536,
+		MaxStreams:          100,
+		Protocols:           []string{"echo/2", "echo/1"},
+	}
+
+	buf := make([]byte, 100)
+	w := NewWriter(buf)
+	if err := want.Encode(w); err != nil {
+		t.Fatalf("err = %v, want %v", err, error(nil))
+	}
+	buf = buf[:w.Len()]
+
+	// Unknown parameters must be skipped.
+	buf = append(buf, 0xfc, 0x10, 'j', 'u', 'n', 'k')
+
+	params, err := DecodeTransportParameters(NewReader(buf))
+	if err != nil {
+		t.Fatalf("err = %v, want %v", err, error(nil))
+	}
+	if !reflect.DeepEqual(params, want) {
+		t.Fatalf("params = %+v, want %+v", params, want)
+	}
+}
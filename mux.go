@@ -22,9 +22,9 @@ var ErrAgain = errors.New("try again")
 type abstractUDPConn interface {
 	Close() error
 	LocalAddr() net.Addr
-	ReadFromUDPAddrPortGRO([]byte) (int, int, netip.AddrPort, error)
+	ReadFromUDPAddrPortGRO([]byte) (int, int, udp.ECN, netip.AddrPort, error)
 	WriteToUDPAddrPort([]byte, netip.AddrPort) (int, error)
-	WriteToUDPAddrPortGSO([]byte, int, netip.AddrPort) (int, error)
+	WriteToUDPAddrPortGSO([]byte, int, udp.ECN, netip.AddrPort) (int, error)
 }
 
 type Mux struct {
@@ -35,6 +35,23 @@ type Mux struct {
 	auth        *cookie.Authenticator
 	jar         syncMap[netip.AddrPort, []byte]
 
+	// The latest handshake timestamps accepted from each peer, by static
+	// public key, since auth was renewed. There's no need to remember
+	// timestamps for longer: handshake messages from before the renewal
+	// carry cookies that don't verify anymore, so can't be replayed.
+	timestamps map[string]tai64n
+
+	// The XX handshakes awaiting the initiator's last message. Like
+	// timestamps, pending is reset when auth is renewed.
+	pending pendingTable[sec.Handshake]
+
+	// The halves of the IKhybrid initiator's messages received so far,
+	// reset along with pending.
+	fragments pendingTable[*[2][]byte]
+
+	timestampMu   sync.Mutex
+	lastTimestamp tai64n // the latest timestamp sent
+
 	once     sync.Once
 	closed   chan struct{}
 	closeErr error
@@ -45,7 +62,7 @@ type Mux struct {
 }
 
 type packetHandler interface {
-	handlePacket([]byte, netip.AddrPort)
+	handlePacket([]byte, netip.AddrPort, udp.ECN)
 }
 
 // cookieAuthRenewalInterval is the time between updates of the cookie
@@ -60,11 +77,18 @@ const cookieAuthRenewalInterval = 2 * time.Minute
 const backlog = 3
 
 func ListenAddrPort(laddr netip.AddrPort, config *Config) (*Mux, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
 	pconn, err := udp.ListenAddrPort(laddr)
 	if err != nil {
 		return nil, err
 	}
+	return newMux(pconn, config), nil
+}
 
+func newMux(pconn abstractUDPConn, config *Config) *Mux {
 	m := &Mux{
 		pconn:  pconn,
 		config: config,
@@ -76,7 +100,7 @@ func ListenAddrPort(laddr netip.AddrPort, config *Config) (*Mux, error) {
 		accept: make(chan *Conn, backlog),
 	}
 	go m.run()
-	return m, nil
+	return m
 }
 
 func (m *Mux) LocalAddrPort() netip.AddrPort {
@@ -94,21 +118,64 @@ func (m *Mux) Accept() (*Conn, error) {
 }
 
 // DialContextAddrPort dials raddr. Note that when DialContextAddrPort returns,
-// peer might not have completed the handshake.
+// peer might not have completed the handshake. If the peer rejects the
+// connection and tells about it, DialContextAddrPort returns a *RejectedError.
+//
+// If remoteStaticPublicKey is nil, the peer's static public key is learned
+// during the handshake and checked by Config.VerifyPeer. This takes an extra
+// round trip. If remoteStaticPublicKey is a hybrid public key, see
+// GenerateHybridPrivateKey, the first handshake message additionally
+// encapsulates a secret to its ML-KEM part, and takes two packets.
+//
+// payload is sent to the peer in the first handshake message, see
+// Config.ResponsePayload. The payload is encrypted, but, unlike data sent over
+// the Conn, can be replayed to the peer by an attacker. The payload the peer
+// responded with is available via Conn.HandshakePayload. payload can be at most
+// MaxHandshakePayloadLen bytes long.
 //
 // See github.com/nanokatze/quic-at-home/transportutil.Dial for a more convenient interface.
-func (m *Mux) DialContextAddrPort(ctx context.Context, remoteStaticPublicKey PublicKey, raddr netip.AddrPort) (*Conn, error) {
+func (m *Mux) DialContextAddrPort(ctx context.Context, remoteStaticPublicKey PublicKey, raddr netip.AddrPort, payload []byte) (*Conn, error) {
+	if len(payload) > MaxHandshakePayloadLen {
+		return nil, errors.New("handshake payload too long")
+	}
+
+	pattern := sec.PatternIK
+	switch {
+	case remoteStaticPublicKey == nil && m.config.PresharedKey != nil:
+		return nil, errors.New("Config.PresharedKey requires the remote static public key")
+
+	case remoteStaticPublicKey == nil:
+		if m.config.VerifyPeer == nil {
+			return nil, errors.New("no remote static public key and no Config.VerifyPeer")
+		}
+		pattern = sec.PatternXX
+
+	case len(remoteStaticPublicKey) == hybridPublicKeySize && m.config.PresharedKey != nil:
+		return nil, errors.New("Config.PresharedKey can't be used with a hybrid remote static public key")
+
+	case len(remoteStaticPublicKey) == hybridPublicKeySize:
+		pattern = sec.PatternIKhybrid
+
+	case m.config.PresharedKey != nil:
+		pattern = sec.PatternIKpsk2
+	}
+
 	cid, err := readConnID(cryptorand.Reader)
 	if err != nil {
 		panic(err)
 	}
 
-	c := newHandshaker(m, cid, raddr)
+	c := newHandshaker(m, cid, raddr, pattern, slices_Clone(payload))
 	if _, ok := c.mux.conns.LoadOrStore(cid, c); ok {
 		return nil, ErrAgain
 	}
 
-	hs := sec.NewHandshake(noisePrologue, m.config.PrivateKey, remoteStaticPublicKey, cryptorand.Reader, sec.InitiatorRole)
+	hs, err := sec.NewHandshake(m.config.CipherSuite.sec(), pattern, noisePrologue, m.config.PrivateKey, remoteStaticPublicKey, cryptorand.Reader, sec.InitiatorRole)
+	if err != nil {
+		c.closeWithError(err)
+		return nil, err
+	}
+	hs.SetPresharedKey(m.config.PresharedKey)
 
 	done := make(chan error)
 	go func() { done <- c.handshake(hs) }()
@@ -118,11 +185,18 @@ func (m *Mux) DialContextAddrPort(ctx context.Context, remoteStaticPublicKey Pub
 		if err != nil {
 			return nil, err
 		}
-		c1, c2, _ := hs.Split()
-		c := newConn(m, cid, c2, c1, raddr)
-		m.conns.Store(cid, c)
-		go c.run()
-		return c, nil
+		c1, c2, h := hs.Split()
+		h1, h2 := hs.HeaderProtection()
+		conn := newConn(m, cid, c2, c1, h2, h1, raddr, true, c.peerParams)
+		conn.remoteStaticPublicKey = hs.RemoteStaticPublicKey()
+		conn.handshakeHash = h
+		conn.handshakePayload = c.peerPayload
+		if len(c.peerParams.Protocols) > 0 {
+			conn.protocol = c.peerParams.Protocols[0]
+		}
+		m.conns.Store(cid, conn)
+		go conn.run()
+		return conn, nil
 
 	case <-ctx.Done():
 		err := ctx.Err()
@@ -135,19 +209,19 @@ func (m *Mux) run() {
 	buf := make([]byte, 65536) // TODO: add a literal for this constant
 
 	for {
-		n, ss, raddr, err := m.pconn.ReadFromUDPAddrPortGRO(buf)
+		n, ss, ecn, raddr, err := m.pconn.ReadFromUDPAddrPortGRO(buf)
 		if err != nil {
 			m.closeWithError(err)
 			return
 		}
 
 		for i := 0; i < n; i += ss {
-			m.handlePacket(buf[i:i+min(ss, n-i)], raddr)
+			m.handlePacket(buf[i:i+min(ss, n-i)], raddr, ecn)
 		}
 	}
 }
 
-func (m *Mux) handlePacket(p []byte, raddr netip.AddrPort) {
+func (m *Mux) handlePacket(p []byte, raddr netip.AddrPort, ecn udp.ECN) {
 	// Too short: a packet must at least have a connection ID and some
 	// payload.
 	if len(p) < 8 {
@@ -155,29 +229,47 @@ func (m *Mux) handlePacket(p []byte, raddr netip.AddrPort) {
 	}
 
 	cid := *(*wire.ConnID)(p[0:8])
-	cid[0] &^= 0xc0
+	cid[0] &^= wire.ConnIDMask
 
 	switch p[0] & 0xc0 {
 	case wire.HandshakePacket:
-		if m.config.Listen && len(p) == maxPacketSize {
+		if m.config.Listen && len(p) == minPacketSize {
 			m.receiveHandshake(p, raddr)
 		}
 
-	case wire.RetryPacket, wire.DataPacket:
+	case wire.NegotiationPacket, wire.RetryPacket, wire.DataPacket:
 		if c, ok := m.conns.Load(cid); ok {
-			c.handlePacket(p, raddr)
+			c.handlePacket(p, raddr, ecn)
 		}
 	}
 }
 
 func (m *Mux) receiveHandshake(p []byte, raddr netip.AddrPort) {
-	_ = p[maxPacketSize-1]
+	_ = p[minPacketSize-1]
 
 	cid := *(*wire.ConnID)(p[0:8])
-	cid[0] &^= 0xc0
+	cid[0] &^= wire.ConnIDMask
 
 	r := wire.NewReader(p[8:])
 
+	// The cipher suite is sent in the clear, so that we can tell the peer
+	// about a mismatch instead of failing to decrypt its message. Like
+	// with a retry, the response is smaller than the initial packet.
+	if suite, _ := r.ReadByte(); CipherSuite(suite) != m.config.CipherSuite {
+		buf := make([]byte, 9)
+		copy(buf, cid[:])
+		buf[0] |= wire.NegotiationPacket
+		buf[8] = byte(m.config.CipherSuite)
+
+		m.pconn.WriteToUDPAddrPort(buf, raddr)
+
+		return
+	}
+
+	kind, err := r.ReadByte()
+	if err != nil {
+		return
+	}
 	cookie, err := wire.DecodeLengthPrefixedBytes(r)
 	if err != nil {
 		return
@@ -194,13 +286,16 @@ func (m *Mux) receiveHandshake(p []byte, raddr netip.AddrPort) {
 	}
 	if m.auth == nil {
 		m.auth = newAuthenticatorOrPanic()
+		m.timestamps = make(map[string]tai64n)
+		m.pending = pendingTable[sec.Handshake]{}
+		m.fragments = pendingTable[*[2][]byte]{}
 	}
 
 	ad := []byte(raddr.String())
 	if !m.auth.Verify(cookie, ad) {
 		fresh := m.auth.MustSign(nil, ad)
 
-		buf := make([]byte, maxPacketSize)
+		buf := make([]byte, minPacketSize)
 		copy(buf, cid[:])
 		buf[0] |= wire.RetryPacket
 
@@ -214,12 +309,110 @@ func (m *Mux) receiveHandshake(p []byte, raddr netip.AddrPort) {
 		return
 	}
 
-	hs := sec.NewHandshake(noisePrologue, m.config.PrivateKey, nil, cryptorand.Reader, sec.ResponderRole)
-	if _, err := hs.ReadMessage(bytes.NewReader(data), 0); err != nil {
+	// Clients not using a pre-shared key when we require one get no
+	// response, and the other way around.
+	switch requiresPresharedKey := m.config.requiresPresharedKey(); {
+	case kind == ikInitiation && !requiresPresharedKey:
+		m.receiveIKInitiation(sec.PatternIK, cid, raddr, data)
+	case kind == ikpsk2Initiation && requiresPresharedKey:
+		m.receiveIKInitiation(sec.PatternIKpsk2, cid, raddr, data)
+	case (kind == ikHybridInitiationFirst || kind == ikHybridInitiationSecond) && !requiresPresharedKey && m.config.PrivateKey.isHybrid():
+		m.receiveIKHybridFragment(cid, raddr, int(kind-ikHybridInitiationFirst), data)
+	case kind == xxInitiation && !requiresPresharedKey:
+		m.receiveXXInitiation(cid, raddr, data)
+	case kind == xxCompletion && !requiresPresharedKey:
+		m.receiveXXCompletion(cid, raddr, data)
+	}
+}
+
+// receiveIKHybridFragment receives the i-th half of the initiator's message of
+// IKhybrid, and handles the message once both halves are received.
+func (m *Mux) receiveIKHybridFragment(cid wire.ConnID, raddr netip.AddrPort, i int, data []byte) {
+	// The halves are only put together if they come from the same
+	// address, so that nobody else can spoil the message.
+	now := time.Now()
+	f, ok := m.fragments.get(cid, raddr, now)
+	if !ok {
+		if !m.fragments.hasRoom(cid, raddr, now) {
+			return
+		}
+		f = new([2][]byte)
+		m.fragments.put(cid, raddr, f, now)
+	}
+	f[i] = append([]byte{}, data...)
+	if f[0] == nil || f[1] == nil {
+		return
+	}
+	m.fragments.delete(cid)
+
+	m.receiveIKInitiation(sec.PatternIKhybrid, cid, raddr, append(f[0], f[1]...))
+}
+
+func (m *Mux) receiveIKInitiation(pattern sec.Pattern, cid wire.ConnID, raddr netip.AddrPort, data []byte) {
+	overhead := initiatorMessageOverhead
+	if pattern == sec.PatternIKhybrid {
+		overhead = hybridInitiatorMessageOverhead
+	}
+	if len(data) < overhead {
+		return
+	}
+	hs, err := sec.NewHandshake(m.config.CipherSuite.sec(), pattern, noisePrologue, m.config.PrivateKey, nil, cryptorand.Reader, sec.ResponderRole)
+	if err != nil {
+		return
+	}
+	payload, err := hs.ReadMessage(bytes.NewReader(data), uint16(len(data)-overhead))
+	if err != nil {
+		return
+	}
+	if len(payload) < len(tai64n{}) {
+		return
+	}
+	timestamp := *(*tai64n)(payload)
+	peerParams, peerPayload, err := decodeHandshakePayload(wire.NewReader(payload[len(timestamp):]))
+	if err != nil {
+		return
+	}
+
+	// Ignore replays of handshake messages. The timestamps of a peer must
+	// be strictly increasing.
+	peer := string(hs.RemoteStaticPublicKey())
+	if last, ok := m.timestamps[peer]; ok && !timestamp.After(last) {
+		return
+	}
+
+	if pattern == sec.PatternIKpsk2 {
+		psk, err := m.config.presharedKey(hs.RemoteStaticPublicKey())
+		if err != nil {
+			return
+		}
+		hs.SetPresharedKey(psk)
+	}
+
+	if m.acceptHandshake(hs, ikSealer(hs), cid, raddr, peerParams, peerPayload) {
+		m.timestamps[peer] = timestamp
+	}
+}
+
+func (m *Mux) receiveXXInitiation(cid wire.ConnID, raddr netip.AddrPort, data []byte) {
+	if len(data) < xxInitiationMessageOverhead {
+		return
+	}
+	if _, ok := m.conns.Load(cid); ok {
+		return
+	}
+	now := time.Now()
+	if !m.pending.hasRoom(cid, raddr, now) {
+		return
+	}
+	hs, err := sec.NewHandshake(m.config.CipherSuite.sec(), sec.PatternXX, noisePrologue, m.config.PrivateKey, nil, cryptorand.Reader, sec.ResponderRole)
+	if err != nil {
+		return
+	}
+	if _, err := hs.ReadMessage(bytes.NewReader(data), uint16(len(data)-xxInitiationMessageOverhead)); err != nil {
 		return
 	}
 
-	buf := make([]byte, maxPacketSize)
+	buf := make([]byte, minPacketSize)
 	copy(buf, cid[:])
 	buf[0] |= wire.DataPacket
 
@@ -227,22 +420,177 @@ func (m *Mux) receiveHandshake(p []byte, raddr netip.AddrPort) {
 	if err := hs.WriteMessage(w, nil); err != nil {
 		return
 	}
+	m.pending.put(cid, raddr, hs, now)
+
+	m.pconn.WriteToUDPAddrPort(buf[:8+w.Len()], raddr)
+}
+
+func (m *Mux) receiveXXCompletion(cid wire.ConnID, raddr netip.AddrPort, data []byte) {
+	// The completion must come from where the initiation came from, or
+	// anyone who learns cid could spoil the handshake.
+	hs, ok := m.pending.get(cid, raddr, time.Now())
+	if !ok || len(data) < xxCompletionMessageOverhead {
+		return
+	}
+	// Whether or not the message is genuine, hs can't read another one.
+	m.pending.delete(cid)
+	payload, err := hs.ReadMessage(bytes.NewReader(data), uint16(len(data)-xxCompletionMessageOverhead))
+	if err != nil {
+		return
+	}
+	peerParams, peerPayload, err := decodeHandshakePayload(wire.NewReader(payload))
+	if err != nil {
+		return
+	}
+
+	m.acceptHandshake(hs, xxSealer(hs, cid), cid, raddr, peerParams, peerPayload)
+}
+
+// A pendingTable holds the state of the handshakes awaiting the initiator's
+// next message, by connection ID. Each entry is bound to the address of the
+// initiator, and is forgotten after pendingHandshakeTimeout. The zero
+// pendingTable is empty and ready to use.
+type pendingTable[V any] struct {
+	entries map[wire.ConnID]pendingEntry[V]
+	perAddr map[netip.Addr]int // number of entries with initiators at each IP address
+}
+
+type pendingEntry[V any] struct {
+	v      V
+	raddr  netip.AddrPort
+	expiry time.Time
+}
 
-	c1, c2, _ := hs.Split()
-	c := newConn(m, cid, c1, c2, raddr)
+// hasRoom reports whether there is room for an entry for cid with the initiator
+// at raddr.
+func (t *pendingTable[V]) hasRoom(cid wire.ConnID, raddr netip.AddrPort, now time.Time) bool {
+	if e, ok := t.entries[cid]; ok && now.Before(e.expiry) {
+		return false
+	}
+	addr := raddr.Addr().Unmap()
+	if len(t.entries) >= maxPendingHandshakes || t.perAddr[addr] >= maxPendingHandshakesPerAddr {
+		t.expire(now)
+	}
+	return len(t.entries) < maxPendingHandshakes && t.perAddr[addr] < maxPendingHandshakesPerAddr
+}
+
+// put adds an entry for cid with the initiator at raddr. The caller must check
+// hasRoom first.
+func (t *pendingTable[V]) put(cid wire.ConnID, raddr netip.AddrPort, v V, now time.Time) {
+	if t.entries == nil {
+		t.entries = make(map[wire.ConnID]pendingEntry[V])
+		t.perAddr = make(map[netip.Addr]int)
+	}
+	t.delete(cid)
+	t.entries[cid] = pendingEntry[V]{v: v, raddr: raddr, expiry: now.Add(pendingHandshakeTimeout)}
+	t.perAddr[raddr.Addr().Unmap()]++
+}
+
+// get returns the entry for cid, if it is with the initiator at raddr and
+// hasn't expired.
+func (t *pendingTable[V]) get(cid wire.ConnID, raddr netip.AddrPort, now time.Time) (V, bool) {
+	e, ok := t.entries[cid]
+	if !ok || e.raddr != raddr || !now.Before(e.expiry) {
+		var zero V
+		return zero, false
+	}
+	return e.v, true
+}
+
+func (t *pendingTable[V]) delete(cid wire.ConnID) {
+	e, ok := t.entries[cid]
+	if !ok {
+		return
+	}
+	delete(t.entries, cid)
+	addr := e.raddr.Addr().Unmap()
+	if t.perAddr[addr]--; t.perAddr[addr] == 0 {
+		delete(t.perAddr, addr)
+	}
+}
+
+// expire forgets the expired entries.
+func (t *pendingTable[V]) expire(now time.Time) {
+	for cid, e := range t.entries {
+		if !now.Before(e.expiry) {
+			t.delete(cid)
+		}
+	}
+}
+
+// acceptHandshake decides whether to accept the connection attempt by the peer
+// authenticated by hs, and responds with the response sealed by seal.
+// acceptHandshake reports whether the connection was queued to be accepted:
+// otherwise, the peer may retry with the same message.
+func (m *Mux) acceptHandshake(hs sec.Handshake, seal handshakeSealer, cid wire.ConnID, raddr netip.AddrPort, peerParams wire.TransportParameters, peerPayload []byte) bool {
+	if authorize := m.config.Authorize; authorize != nil {
+		if err := authorize(hs.RemoteStaticPublicKey(), raddr); err != nil {
+			if m.config.NotifyRejected {
+				m.rejectHandshake(seal, cid, raddr, err.Error())
+			}
+			return false
+		}
+	}
+
+	protocol, err := selectProtocol(m.config.Protocols, peerParams.Protocols)
+	if err != nil {
+		if m.config.NotifyRejected {
+			m.rejectHandshake(seal, cid, raddr, err.Error())
+		}
+		return false
+	}
+
+	var responsePayload []byte
+	if respond := m.config.ResponsePayload; respond != nil {
+		responsePayload, err = respond(hs.RemoteStaticPublicKey(), raddr, peerPayload)
+		if err == nil && len(responsePayload) > MaxHandshakePayloadLen {
+			err = errors.New("handshake response payload too long")
+		}
+		if err != nil {
+			if m.config.NotifyRejected {
+				m.rejectHandshake(seal, cid, raddr, err.Error())
+			}
+			return false
+		}
+	}
+
+	buf := make([]byte, minPacketSize)
+	copy(buf, cid[:])
+	buf[0] |= wire.DataPacket
+
+	w := wire.NewWriter(buf[8:])
+
+	params := m.config.transportParameters()
+	params.Protocols = nil
+	if protocol != "" {
+		params.Protocols = []string{protocol}
+	}
+	if err := seal(w, append([]byte{handshakeAccepted}, encodeHandshakePayload(params, responsePayload)...)); err != nil {
+		return false
+	}
+
+	c1, c2, h := hs.Split()
+	h1, h2 := hs.HeaderProtection()
+	c := newConn(m, cid, c1, c2, h1, h2, raddr, false, peerParams)
+	c.remoteStaticPublicKey = hs.RemoteStaticPublicKey()
+	c.handshakeHash = h
+	c.handshakePayload = peerPayload
+	c.protocol = protocol
 	// If we already have a connection with the same ID, ignore this
 	// connection attempt.
 	if _, ok := m.conns.LoadOrStore(cid, c); ok {
-		return
+		return false
 	}
 	select {
 	case m.accept <- c:
 		go c.run()
 
 		m.pconn.WriteToUDPAddrPort(buf[:8+w.Len()], raddr)
+		return true
 
 	default:
 		m.conns.Delete(cid)
+		return false
 	}
 }
 
@@ -280,6 +628,20 @@ func readConnID(r io.Reader) (wire.ConnID, error) {
 	if _, err := io.ReadFull(r, cid[:]); err != nil {
 		return wire.ConnID{}, err
 	}
-	cid[0] &^= 0xc0
+	cid[0] &^= wire.ConnIDMask
 	return wire.ConnID(cid), nil
 }
+
+// timestamp returns a timestamp for a handshake message. The timestamps are
+// strictly increasing, even if called in rapid succession.
+func (m *Mux) timestamp() tai64n {
+	m.timestampMu.Lock()
+	defer m.timestampMu.Unlock()
+
+	ts := tai64nFromTime(time.Now())
+	if !ts.After(m.lastTimestamp) {
+		ts = m.lastTimestamp.next()
+	}
+	m.lastTimestamp = ts
+	return ts
+}
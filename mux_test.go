@@ -0,0 +1,220 @@
+package quic
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nanokatze/quic-at-home/internal/udp"
+	"github.com/nanokatze/quic-at-home/internal/wire"
+)
+
+// lossyUDPConn drops some of the data packets written to it.
+type lossyUDPConn struct {
+	abstractUDPConn
+
+	// If every is positive, every every-th data packet is dropped: all of
+	// them if every is 1.
+	every atomic.Int64
+	n     atomic.Int64
+
+	lastHandshake atomic.Pointer[[]byte] // the last handshake packet written
+}
+
+// lost reports whether the data packet p is to be dropped.
+func (c *lossyUDPConn) lost(p []byte) bool {
+	if len(p) == 0 || p[0]&0xc0 != wire.DataPacket {
+		return false
+	}
+	every := c.every.Load()
+	return every > 0 && c.n.Add(1)%every == 0
+}
+
+func (c *lossyUDPConn) WriteToUDPAddrPort(b []byte, raddr netip.AddrPort) (int, error) {
+	if len(b) > 0 && b[0]&0xc0 == wire.HandshakePacket {
+		p := slices_Clone(b)
+		c.lastHandshake.Store(&p)
+	}
+	if c.lost(b) {
+		return len(b), nil
+	}
+	return c.abstractUDPConn.WriteToUDPAddrPort(b, raddr)
+}
+
+func (c *lossyUDPConn) WriteToUDPAddrPortGSO(b []byte, ss int, ecn udp.ECN, raddr netip.AddrPort) (int, error) {
+	for i := 0; i < len(b); i += ss {
+		p := b[i : i+min(ss, len(b)-i)]
+		if c.lost(p) {
+			continue
+		}
+		if _, err := c.abstractUDPConn.WriteToUDPAddrPortGSO(p, ss, ecn, raddr); err != nil {
+			return i, err
+		}
+	}
+	return len(b), nil
+}
+
+// newTestMux returns a Mux listening on loopback with config, whose packets go
+// through the returned lossyUDPConn. config gets a fresh private key, and
+// usable stream windows unless set.
+func newTestMux(t *testing.T, config Config) (*Mux, *lossyUDPConn) {
+	t.Helper()
+
+	privKey, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.PrivateKey = privKey
+	if config.StreamReceiveWindow == 0 {
+		config.StreamReceiveWindow = 1 << 20
+	}
+	if config.MaxStreamBytesInFlight == 0 {
+		config.MaxStreamBytesInFlight = 1 << 20
+	}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	pconn, err := udp.ListenAddrPort(netip.MustParseAddrPort("127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lossy := &lossyUDPConn{abstractUDPConn: pconn}
+	m := newMux(lossy, &config)
+	t.Cleanup(func() { m.Close() })
+	return m, lossy
+}
+
+// dialTestMux connects cli to srv, and returns both ends of the connection.
+func dialTestMux(t *testing.T, cli, srv *Mux) (c, sc *Conn) {
+	t.Helper()
+
+	var err error
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		c, err = cli.DialContextAddrPort(ctx, srv.config.PrivateKey.Public(), srv.LocalAddrPort(), nil)
+		cancel()
+		if err != ErrAgain {
+			break // the first attempt only fetches the cookie
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc, err = srv.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, sc
+}
+
+func TestPendingTable(t *testing.T) {
+	var pending pendingTable[int]
+	now := time.Now()
+	raddr := netip.MustParseAddrPort("192.0.2.1:1234")
+	other := netip.MustParseAddrPort("192.0.2.2:1234")
+
+	cid := wire.ConnID{1}
+	if !pending.hasRoom(cid, raddr, now) {
+		t.Fatalf("no room in an empty table")
+	}
+	pending.put(cid, raddr, 1, now)
+	if pending.hasRoom(cid, other, now) {
+		t.Fatalf("room for an entry already there")
+	}
+
+	// The entry is only for the initiator it was put for, and only until
+	// it expires.
+	if _, ok := pending.get(cid, other, now); ok {
+		t.Fatalf("got the entry for another address")
+	}
+	if v, ok := pending.get(cid, raddr, now); !ok || v != 1 {
+		t.Fatalf("get = %v, %v, want %v, %v", v, ok, 1, true)
+	}
+	later := now.Add(pendingHandshakeTimeout)
+	if _, ok := pending.get(cid, raddr, later); ok {
+		t.Fatalf("got an expired entry")
+	}
+	if !pending.hasRoom(cid, other, later) {
+		t.Fatalf("no room in place of an expired entry")
+	}
+
+	// An address can only have so many entries, even from different
+	// ports, but that doesn't keep out the others.
+	for i := 2; i <= maxPendingHandshakesPerAddr; i++ {
+		cid := wire.ConnID{byte(i)}
+		raddr := netip.AddrPortFrom(raddr.Addr(), uint16(i))
+		if !pending.hasRoom(cid, raddr, now) {
+			t.Fatalf("no room for entry %d", i)
+		}
+		pending.put(cid, raddr, i, now)
+	}
+	if pending.hasRoom(wire.ConnID{0xff}, netip.AddrPortFrom(raddr.Addr(), 1), now) {
+		t.Fatalf("room for more than %d entries for an address", maxPendingHandshakesPerAddr)
+	}
+	if !pending.hasRoom(wire.ConnID{0xff}, other, now) {
+		t.Fatalf("no room for another address")
+	}
+
+	// Expired entries make room.
+	if !pending.hasRoom(wire.ConnID{0xff}, raddr, later) {
+		t.Fatalf("expired entries take up room")
+	}
+	if len(pending.entries) != 0 || len(pending.perAddr) != 0 {
+		t.Fatalf("%d entries and %d addresses left after expiry", len(pending.entries), len(pending.perAddr))
+	}
+}
+
+// TestHandshakeBacklogFull checks that an initiation dropped because the
+// backlog of connections to accept was full can be retried, rather than be
+// taken as a replay.
+func TestHandshakeBacklogFull(t *testing.T) {
+	srv, _ := newTestMux(t, Config{Listen: true})
+	for i := 0; i < backlog; i++ {
+		cli, _ := newTestMux(t, Config{})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := cli.DialContextAddrPort(ctx, srv.config.PrivateKey.Public(), srv.LocalAddrPort(), nil)
+		if err == ErrAgain {
+			_, err = cli.DialContextAddrPort(ctx, srv.config.PrivateKey.Public(), srv.LocalAddrPort(), nil)
+		}
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cli, cliConn := newTestMux(t, Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := cli.DialContextAddrPort(ctx, srv.config.PrivateKey.Public(), srv.LocalAddrPort(), nil)
+	if err == ErrAgain {
+		_, err = cli.DialContextAddrPort(ctx, srv.config.PrivateKey.Public(), srv.LocalAddrPort(), nil)
+	}
+	if err == nil {
+		t.Fatalf("dial succeeded with the backlog full")
+	}
+
+	// Once there's room, the same initiation gets the connection queued.
+	for i := 0; i < backlog; i++ {
+		if _, err := srv.Accept(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cliConn.abstractUDPConn.WriteToUDPAddrPort(*cliConn.lastHandshake.Load(), srv.LocalAddrPort()); err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan struct{})
+	go func() {
+		if _, err := srv.Accept(); err == nil {
+			close(accepted)
+		}
+	}()
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Fatalf("retried initiation not accepted")
+	}
+}
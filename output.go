@@ -6,6 +6,7 @@ import (
 	"net/netip"
 	"time"
 
+	"github.com/nanokatze/quic-at-home/internal/sec"
 	"github.com/nanokatze/quic-at-home/internal/wire"
 )
 
@@ -18,11 +19,13 @@ func (c *Conn) nextPacketNumber() wire.PacketNumber {
 	return wire.PacketNumber(pn)
 }
 
-func (c *Conn) sendPacket(dst []byte, now time.Time) (int, netip.AddrPort /* probe addr */) {
+// sendPacket writes the next packet to send to dst. ecn tells whether the packet
+// will be marked ECT(0).
+func (c *Conn) sendPacket(dst []byte, ecn bool, now time.Time) (int, netip.AddrPort /* probe addr */) {
 	copy(dst[:8], c.id[:])
 	dst[0] |= wire.DataPacket
 
-	w := wire.NewWriter(dst[12 : maxPacketSize-16])
+	w := wire.NewWriter(dst[12 : len(dst)-16])
 
 	var p inFlightPacket
 
@@ -31,21 +34,25 @@ func (c *Conn) sendPacket(dst []byte, now time.Time) (int, netip.AddrPort /* pro
 		c.sendClose(w)
 
 	default:
-		cwndLimited := c.congestionController.CwndLimited(c.inFlightBytes, c.rttFilter.PTO(), now)
+		cwndLimited := c.congestionController.CwndLimited(c.inFlightBytes, now)
+		// Waiting for the pacer only holds back new data, it doesn't
+		// call for a tail ACK.
+		pacingLimited := !c.pacer.Ready(c.maxPacketSize, pacingRate(c.congestionController, c.rttFilter), now)
 
 		c.maybeSendAck(w, &p, cwndLimited, now)
-		if cwndLimited {
+		if cwndLimited || pacingLimited {
 			break
 		}
 
-		c.maybeSendMaxStreamOffset(w, &p)
+		c.maybeSendMaxStreams(w, &p)
+		c.maybeSendMaxStreamData(w, &p)
 
 		if rand.Int()&1 == 0 {
-			c.maybeSendStream(w, &p)
+			c.maybeSendStreams(w, &p)
 			c.maybeSendMsg(w, &p)
 		} else {
 			c.maybeSendMsg(w, &p)
-			c.maybeSendStream(w, &p)
+			c.maybeSendStreams(w, &p)
 		}
 	}
 
@@ -62,13 +69,73 @@ func (c *Conn) sendPacket(dst []byte, now time.Time) (int, netip.AddrPort /* pro
 		p.paddr = c.migrationAddr
 	}
 
+	if t := c.keepAliveTime(); !t.IsZero() && !now.Before(t) {
+		select {
+		case <-c.closed:
+		default:
+			c.lastKeepAliveTime = now
+
+			if !p.AckEliciting() {
+				if err := (wire.Ping{}).Encode(w); err != nil {
+					panic(err)
+				}
+				p.containsPing = true
+			}
+		}
+	}
+
 	if w.Len() == 0 {
 		return 0, netip.AddrPort{} // nothing to send
 	}
 
+	// Pad the packet with PADDING frames. The frames written above
+	// omit their length only when they fill the packet up, so padding can
+	// go after them.
+	if c.padder != nil {
+		padding := c.padder(12+w.Len()+16, len(dst)) - (12 + w.Len() + 16)
+		for i := 0; i < padding; i++ {
+			if err := w.WriteByte(0x00); err != nil {
+				panic(err)
+			}
+		}
+		p.padding = max(padding, 0)
+		c.paddingBytesSent += int64(p.padding)
+	}
+
+	p.ecn = ecn
 	p.sent = now
 
-	// Fill in packet size. The real packet size has additional unknown C
+	return c.sealPacket(dst, w, p, now), p.paddr
+}
+
+// sendPMTUProbe writes a PMTU probe to dst: a PING padded to fill dst up.
+func (c *Conn) sendPMTUProbe(dst []byte, now time.Time) {
+	copy(dst[:8], c.id[:])
+	dst[0] |= wire.DataPacket
+
+	w := wire.NewWriter(dst[12 : len(dst)-16])
+
+	if err := (wire.Ping{}).Encode(w); err != nil {
+		panic(err)
+	}
+	for w.Remaining() > 0 {
+		if err := w.WriteByte(0x00); err != nil {
+			panic(err)
+		}
+	}
+
+	c.sealPacket(dst, w, inFlightPacket{
+		containsPing: true,
+		pmtuProbe:    true,
+		sent:         now,
+	}, now)
+}
+
+// sealPacket numbers, seals and protects the packet p, whose frames were
+// written to dst with w, and returns its size.
+func (c *Conn) sealPacket(dst []byte, w *wire.Writer, p inFlightPacket, now time.Time) int {
+	// Fill in packet size, padding included: it takes up the path like
+	// any other bytes. The real packet size has additional unknown C
 	// bytes of overhead. Underestimating C will cause the congestion window
 	// to be overshot at smaller packet sizes, but this is not a problem in
 	// practice, as small packets are infrequent.
@@ -80,7 +147,14 @@ func (c *Conn) sendPacket(dst []byte, now time.Time) (int, netip.AddrPort /* pro
 		c.inFlightPackets[pn] = p
 		c.inFlightBytes += p.size
 
-		c.congestionController.Validate(c.inFlightBytes, c.rttFilter.PTO(), now)
+		if !p.pmtuProbe {
+			c.congestionController.Sent(p.size, p.padding, now)
+			c.congestionController.Validate(c.inFlightBytes, now)
+			c.pacer.Sent(p.size)
+			if p.ecn {
+				c.ecn.sent()
+			}
+		}
 
 		c.timeout = now.Add(c.rttFilter.PTO() << c.timeoutBackoff)
 
@@ -90,10 +164,47 @@ func (c *Conn) sendPacket(dst []byte, now time.Time) (int, netip.AddrPort /* pro
 	// Fill in the packet number
 	binary.LittleEndian.PutUint32(dst[8:12], uint32(pn))
 
+	c.maybeUpdateSendKey(pn, now)
+	if c.sendKeyPhase {
+		dst[0] |= wire.KeyPhase
+	}
+
 	// Seal
-	c.sendAEAD.Seal(dst[12:12], uint64(pn), dst[12:12+w.Len()], c.id[:])
+	c.sendAEAD.Seal(dst[12:12], uint64(pn), dst[12:12+w.Len()], dst[0:8])
 
-	return 12 + w.Len() + 16, p.paddr
+	protectHeader(c.sendHP, dst)
+
+	return 12 + w.Len() + 16
+}
+
+// protectHeader masks the key phase bit and the packet number of the sealed
+// packet p, or unmasks them. The mask depends only on the ciphertext, so the
+// same call does either.
+func protectHeader(hp sec.HeaderProtection, p []byte) {
+	mask := hp.Mask(p[wire.HeaderSampleOffset : wire.HeaderSampleOffset+wire.HeaderSampleSize])
+	p[0] ^= mask[0] & wire.KeyPhase
+	for i := 0; i < 4; i++ {
+		p[8+i] ^= mask[1+i]
+	}
+}
+
+// maybeUpdateSendKey updates the keys packets are sent with, starting with
+// packet pn, if it is time to.
+func (c *Conn) maybeUpdateSendKey(pn wire.PacketNumber, now time.Time) {
+	if !c.sendKeyPhaseAcked {
+		return // the peer might not have switched to the current keys yet
+	}
+	if pn-c.sendKeyPhaseStartPN < c.keyUpdatePackets && now.Sub(c.sendKeyUpdateTime) < keyUpdateInterval {
+		return
+	}
+
+	c.sendAEAD = c.sendAEAD.Rekey()
+	c.sendKeyPhase = !c.sendKeyPhase
+	c.sendKeyPhaseStartPN = pn
+	c.sendKeyPhaseAcked = false
+	c.sendKeyUpdateTime = now
+
+	c.keyUpdates++
 }
 
 func (c *Conn) maybeSendAck(w *wire.Writer, p *inFlightPacket, cwndLimited bool, now time.Time) {
@@ -102,10 +213,13 @@ func (c *Conn) maybeSendAck(w *wire.Writer, p *inFlightPacket, cwndLimited bool,
 	}
 
 	if !c.sendAckBy.IsZero() && !now.Before(c.sendAckBy) || cwndLimited && !c.sentTailAck {
-		if err := (wire.Ack{
-			Delay:  min(now.Sub(c.maxRcvdPNRcvTime), maxAckDelay),
+		ack := wire.Ack{
+			Delay:  min(now.Sub(c.maxRcvdPNRcvTime), c.maxAckDelay),
 			Ranges: c.maxRcvdPNRanges,
-		}).Encode(w); err != nil {
+			ECN:    c.ecnCounts,
+		}
+		n := wire.AckMaxRangeCount(w.Remaining(), ack) // how many ranges Encode writes
+		if err := ack.Encode(w); err != nil {
 			panic(err)
 		}
 
@@ -116,7 +230,9 @@ func (c *Conn) maybeSendAck(w *wire.Writer, p *inFlightPacket, cwndLimited bool,
 			c.tailAcksSent++
 		}
 
-		p.maxPNAcks = c.maxRcvdPNRanges.Max()
+		if n > 1 {
+			p.acks = slices_Clone(c.maxRcvdPNRanges[1:n])
+		}
 	}
 	if !cwndLimited {
 		// Not congested anymore
@@ -124,37 +240,89 @@ func (c *Conn) maybeSendAck(w *wire.Writer, p *inFlightPacket, cwndLimited bool,
 	}
 }
 
-func (c *Conn) maybeSendMaxStreamOffset(w *wire.Writer, p *inFlightPacket) {
-	off := c.streamReassembler.MaxOffset()
-	if c.maxStreamOffAcked < off && c.maxStreamOffInFlight < off {
-		c.maxStreamOffInFlight = off
+func (c *Conn) maybeSendMaxStreams(w *wire.Writer, p *inFlightPacket) {
+	if c.maxPeerStreamsAcked < c.maxPeerStreams && c.maxPeerStreamsInFlight < c.maxPeerStreams {
+		m := wire.MaxStreams{Max: c.maxPeerStreams}
+		if w.Remaining() < m.Len() {
+			return
+		}
+
+		c.maxPeerStreamsInFlight = m.Max
 
-		if err := wire.MaxStreamData(off).Encode(w); err != nil {
+		if err := m.Encode(w); err != nil {
 			panic(err)
 		}
 
-		p.maxStreamOff = off
+		p.maxStreams = m.Max
 	}
 }
 
-func (c *Conn) maybeSendStream(w *wire.Writer, p *inFlightPacket) {
-	for len(c.streamFragments) > 0 {
-		// TODO: coalesce fragments for less wire overhead
-		f := c.streamFragments[0]
+func (c *Conn) maybeSendMaxStreamData(w *wire.Writer, p *inFlightPacket) {
+	// Map iteration order is random, so that no stream is starved of
+	// MAX_STREAM_DATA when there are more of them than fit in a packet.
+	for _, s := range c.streams {
+		if s.finOff >= 0 {
+			continue // the peer won't send any more data
+		}
+
+		off := s.reassembler.MaxOffset()
+		if s.maxOffAcked < off && s.maxOffInFlight < off {
+			m := wire.MaxStreamData{
+				ID:  s.id,
+				Off: off,
+			}
+			if w.Remaining() < m.Len() {
+				break
+			}
+
+			s.maxOffInFlight = off
+
+			if err := m.Encode(w); err != nil {
+				panic(err)
+			}
+
+			p.maxStreamData = append(p.maxStreamData, m)
+		}
+	}
+}
+
+func (c *Conn) maybeSendStreams(w *wire.Writer, p *inFlightPacket) {
+	// TODO: schedule streams in a fairer way than map iteration order
+	for _, s := range c.streams {
+		c.maybeSendStream(w, p, s)
+	}
+}
 
-		n, explicitLen := wire.StreamMaxDataLen(w.Remaining(), f.off, len(f.data))
+func (c *Conn) maybeSendStream(w *wire.Writer, p *inFlightPacket, s *Stream) {
+	for len(s.fragments) > 0 {
+		// TODO: coalesce fragments for less wire overhead
+		f := s.fragments[0]
+
+		var n int
+		var explicitLen bool
+		if len(f.data) == 0 {
+			// A FIN with no data.
+			if w.Remaining() < wire.StreamFinLen(f.id, f.off) {
+				break
+			}
+			explicitLen = true
+		} else {
+			n, explicitLen = wire.StreamMaxDataLen(w.Remaining(), f.id, f.off, len(f.data))
+		}
 		if n == len(f.data) {
-			c.streamFragments = c.streamFragments[1:]
+			s.fragments = s.fragments[1:]
 		} else if n > 0 {
-			f, c.streamFragments[0] = f.Split(n)
+			f, s.fragments[0] = f.Split(n)
 		} else {
-			// TODO: explain why it is ok to retain c.streamFragments
+			// TODO: explain why it is ok to retain s.fragments
 			break
 		}
 
 		if err := (wire.Stream{
+			ID:   f.id,
 			Off:  f.off,
 			Data: f.data,
+			Fin:  f.fin,
 		}).Encode(w, explicitLen); err != nil {
 			panic(err)
 		}
@@ -206,7 +374,9 @@ func (c *Conn) maybeSendMsg(w *wire.Writer, p *inFlightPacket) {
 }
 
 func (c *Conn) sendClose(w *wire.Writer) {
-	if err := (wire.Close{}).Encode(w); err != nil {
+	f := c.closeFrame
+	f.Reason = truncateUTF8(f.Reason, wire.CloseMaxReasonLen(w.Remaining(), f.Code, len(f.Reason)))
+	if err := f.Encode(w); err != nil {
 		panic(err)
 	}
 }
@@ -0,0 +1,54 @@
+package quic
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nanokatze/quic-at-home/internal/wire"
+)
+
+// TestMaybeSendAckTruncated checks that a packet carrying an ACK that left out
+// ranges to fit only remembers the ranges it reported.
+func TestMaybeSendAckTruncated(t *testing.T) {
+	now := time.Now()
+	c := &Conn{sendAckBy: now}
+	for pn := wire.PacketNumber(0); pn < 100; pn += 2 {
+		c.maxRcvdPNRanges = c.maxRcvdPNRanges.Insert(pn)
+	}
+
+	var p inFlightPacket
+	buf := make([]byte, 20)
+	w := wire.NewWriter(buf)
+	c.maybeSendAck(w, &p, false, now)
+
+	ack, err := wire.DecodeAck(wire.NewReader(buf[:w.Len()]), len(c.maxRcvdPNRanges))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ack.Ranges) == len(c.maxRcvdPNRanges) {
+		t.Fatalf("ACK not truncated")
+	}
+	if !reflect.DeepEqual(p.acks, ack.Ranges[1:]) {
+		t.Fatalf("packet remembers %v, want %v", p.acks, ack.Ranges[1:])
+	}
+}
+
+// TestTailAcks checks that a sender paced between bursts doesn't take itself
+// for congestion limited, sending a tail ACK at the end of every burst.
+func TestTailAcks(t *testing.T) {
+	srv, _ := newTestMux(t, Config{Listen: true})
+	cli, _ := newTestMux(t, Config{})
+	c, sc := dialTestMux(t, cli, srv)
+
+	data := bytes.Repeat([]byte("0123456789"), 200000)
+	writeAll(t, data, c.stream)
+	readFull(t, sc.stream, data)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tailAcksSent > c.seq/25 {
+		t.Fatalf("sent %d tail ACKs in %d packets", c.tailAcksSent, c.seq)
+	}
+}
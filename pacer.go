@@ -0,0 +1,68 @@
+package quic
+
+import (
+	"math"
+	"time"
+)
+
+// pacingGain scales the pacing rate of congestion controllers that don't pace
+// on their own, so that the window can be sent in a bit less than an RTT. See
+// RFC 9002, Section 7.7.
+const pacingGain = 1.25
+
+// pacerMaxBurst is the burst allowance of the pacer, in packets. The allowance
+// is higher if the pacing rate is high enough for more packets to leave within
+// timerGranularity, so that they can still be sent with a single
+// WriteToUDPAddrPortGSO call.
+const pacerMaxBurst = 4
+
+// pacer spreads out the ack-eliciting packets sent over the RTT, instead of
+// letting a connection send its congestion window in a burst that could
+// overflow the buffers on the path. It is a token bucket filled at the pacing
+// rate.
+type pacer struct {
+	budget float64   // bytes that can be sent right away
+	filled time.Time // when budget was last filled
+}
+
+// pacingRate returns the rate to pace packets at, in bytes per second: the
+// rate cc asks for, or the congestion window per smoothed RTT.
+func pacingRate(cc CongestionController, rtt RTTStats) float64 {
+	if cc, ok := cc.(PacingCongestionController); ok {
+		return cc.PacingRate()
+	}
+	return pacingGain * float64(cc.Cwnd()) / rtt.SmoothedRTT().Seconds()
+}
+
+func (p *pacer) fill(maxPacketSize int, rate float64, now time.Time) {
+	maxBudget := math.Max(pacerMaxBurst*float64(maxPacketSize), rate*timerGranularity.Seconds())
+	if p.filled.IsZero() {
+		p.budget = maxBudget
+	} else if elapsed := now.Sub(p.filled); elapsed > 0 {
+		p.budget = math.Min(p.budget+rate*elapsed.Seconds(), maxBudget)
+	}
+	p.filled = now
+}
+
+// Ready reports whether a packet of maxPacketSize can be sent at rate bytes per
+// second.
+func (p *pacer) Ready(maxPacketSize int, rate float64, now time.Time) bool {
+	p.fill(maxPacketSize, rate, now)
+	return p.budget >= float64(maxPacketSize)
+}
+
+// Sent takes a packet of size bytes out of the budget.
+func (p *pacer) Sent(size int) {
+	p.budget -= float64(size)
+}
+
+// NextSendTime returns when a packet of maxPacketSize can be sent at rate bytes
+// per second, or zero time if it can already be. It rounds up, so that the
+// packet is ready by then despite floating-point error.
+func (p *pacer) NextSendTime(maxPacketSize int, rate float64, now time.Time) time.Time {
+	p.fill(maxPacketSize, rate, now)
+	if p.budget >= float64(maxPacketSize) {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(math.Ceil((float64(maxPacketSize)-p.budget)/rate*float64(time.Second))) + time.Nanosecond)
+}
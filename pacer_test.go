@@ -0,0 +1,80 @@
+package quic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacer(t *testing.T) {
+	const maxPacketSize = 1000
+	const rate = 100e3 // a packet every 10ms
+
+	var p pacer
+	now := time.Date(2000, 1, 1, 1, 1, 1, 0, time.UTC)
+
+	// The burst allowance can be sent right away.
+	for i := 0; i < pacerMaxBurst; i++ {
+		if !p.Ready(maxPacketSize, rate, now) {
+			t.Fatalf("packet %d of the burst not ready", i)
+		}
+		p.Sent(maxPacketSize)
+	}
+	if p.Ready(maxPacketSize, rate, now) {
+		t.Fatalf("ready after the burst")
+	}
+
+	// The rest is spread out at the rate.
+	next := p.NextSendTime(maxPacketSize, rate, now)
+	if d := next.Sub(now); d < 10*time.Millisecond || 10*time.Millisecond+time.Microsecond < d {
+		t.Fatalf("next send time in %v, want in 10ms", d)
+	}
+	if p.Ready(maxPacketSize, rate, now.Add(9*time.Millisecond)) {
+		t.Fatalf("ready before the next send time")
+	}
+	now = next
+	if !p.Ready(maxPacketSize, rate, now) {
+		t.Fatalf("not ready at the next send time")
+	}
+	if next := p.NextSendTime(maxPacketSize, rate, now); !next.IsZero() {
+		t.Fatalf("next send time = %v, want zero", next)
+	}
+	p.Sent(maxPacketSize)
+
+	// Idling doesn't earn more than the burst allowance.
+	now = now.Add(time.Second)
+	for i := 0; i < pacerMaxBurst; i++ {
+		if !p.Ready(maxPacketSize, rate, now) {
+			t.Fatalf("packet %d of the burst not ready after idling", i)
+		}
+		p.Sent(maxPacketSize)
+	}
+	if p.Ready(maxPacketSize, rate, now) {
+		t.Fatalf("ready after the burst after idling")
+	}
+}
+
+// TestPacerHighRate checks that the pacer allows as many packets as the rate
+// sends in timerGranularity at once, so that they can be batched.
+func TestPacerHighRate(t *testing.T) {
+	const maxPacketSize = 1000
+	const rate = 100e6
+
+	var p pacer
+	now := time.Date(2000, 1, 1, 1, 1, 1, 0, time.UTC)
+
+	n := 0
+	for p.Ready(maxPacketSize, rate, now) {
+		p.Sent(maxPacketSize)
+		n++
+	}
+	if want := int(rate * timerGranularity.Seconds() / maxPacketSize); n != want {
+		t.Fatalf("burst = %d packets, want %d", n, want)
+	}
+}
+
+func TestPacingRate(t *testing.T) {
+	cc := NewRenoCongestionController(1000, testRTTStats, time.Time{})
+	if rate, want := pacingRate(cc, testRTTStats), pacingGain*float64(cc.Cwnd())/testRTTStats.smoothedRTT.Seconds(); rate != want {
+		t.Fatalf("pacing rate = %v, want %v", rate, want)
+	}
+}
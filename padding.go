@@ -0,0 +1,71 @@
+package quic
+
+import "sort"
+
+// A PaddingPolicy decides how much padding to add to the packets of a
+// connection, see Config.PaddingPolicy. Padding hides the sizes of the writes
+// and messages the packets carry from observers, at the cost of bandwidth.
+type PaddingPolicy interface {
+	// newPadder returns the padder of a new connection.
+	newPadder() padder
+}
+
+// A padder returns the size to pad a packet of the given size to. The result
+// is capped at the connection's maxPacketSize.
+type padder func(size, maxPacketSize int) int
+
+// PadToMaxPacketSize pads every packet to the connection's max packet size.
+func PadToMaxPacketSize() PaddingPolicy { return padToMaxPacketSize{} }
+
+type padToMaxPacketSize struct{}
+
+func (padToMaxPacketSize) newPadder() padder {
+	return func(size, maxPacketSize int) int { return maxPacketSize }
+}
+
+// PadToBuckets pads every packet to the smallest of sizes that is at least as
+// large as the packet, or to the connection's max packet size if there's none.
+// The sizes include the packet header and the AEAD tag.
+func PadToBuckets(sizes ...int) PaddingPolicy {
+	sizes = slices_Clone(sizes)
+	sort.Ints(sizes)
+	return padToBuckets{sizes}
+}
+
+type padToBuckets struct {
+	sizes []int
+}
+
+func (policy padToBuckets) newPadder() padder {
+	return func(size, maxPacketSize int) int {
+		for _, bucket := range policy.sizes {
+			if size <= bucket {
+				return min(bucket, maxPacketSize)
+			}
+		}
+		return maxPacketSize
+	}
+}
+
+// PadToRecentMax pads every packet to the size of the largest of the last n
+// packets, before padding, including itself. This smooths out the sizes of
+// bursts of packets at a lower cost than the other policies.
+func PadToRecentMax(n int) PaddingPolicy { return padToRecentMax{n} }
+
+type padToRecentMax struct {
+	n int
+}
+
+func (policy padToRecentMax) newPadder() padder {
+	recent := make([]int, policy.n) // ring buffer of the last n sizes
+	i := 0
+	return func(size, maxPacketSize int) int {
+		recent[i] = size
+		i = (i + 1) % len(recent)
+		padded := 0
+		for _, size := range recent {
+			padded = max(padded, size)
+		}
+		return min(padded, maxPacketSize)
+	}
+}
@@ -0,0 +1,95 @@
+package quic
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var paddingPolicyTests = []struct {
+	name   string
+	policy PaddingPolicy
+	sizes  []int // sizes of the consecutive packets before padding
+	padded []int
+}{
+	{
+		name:   "max packet size",
+		policy: PadToMaxPacketSize(),
+		sizes:  []int{29, 500, 1400},
+		padded: []int{1400, 1400, 1400},
+	},
+	{
+		name:   "buckets",
+		policy: PadToBuckets(1024, 128, 256),
+		sizes:  []int{29, 128, 129, 1000, 1025},
+		padded: []int{128, 128, 256, 1024, 1400},
+	},
+	{
+		name:   "buckets above max packet size",
+		policy: PadToBuckets(2048),
+		sizes:  []int{29},
+		padded: []int{1400},
+	},
+	{
+		name:   "recent max",
+		policy: PadToRecentMax(3),
+		sizes:  []int{100, 50, 200, 60, 70, 80, 30},
+		padded: []int{100, 100, 200, 200, 200, 80, 80},
+	},
+}
+
+func TestPaddingPolicy(t *testing.T) {
+	const maxPacketSize = 1400
+
+	for _, test := range paddingPolicyTests {
+		t.Run(test.name, func(t *testing.T) {
+			pad := test.policy.newPadder()
+			for i, size := range test.sizes {
+				if got := pad(size, maxPacketSize); got != test.padded[i] {
+					t.Errorf("packet %d of size %d padded to %d, want %d", i, size, got, test.padded[i])
+				}
+			}
+		})
+	}
+}
+
+// paddingCounter is a CongestionController counting the padding it is told
+// about.
+type paddingCounter struct {
+	CongestionController
+	padding *atomic.Int64
+}
+
+func (c paddingCounter) Sent(size, padding int, now time.Time) {
+	c.padding.Add(int64(padding))
+	c.CongestionController.Sent(size, padding, now)
+}
+
+// TestPaddingBytesSent checks that the padding is accounted apart from the
+// data, both by the congestion controller and by Conn.PaddingBytesSent.
+func TestPaddingBytesSent(t *testing.T) {
+	srv, _ := newTestMux(t, Config{Listen: true})
+	var padding atomic.Int64
+	cli, _ := newTestMux(t, Config{
+		PaddingPolicy: PadToMaxPacketSize(),
+		NewCongestionController: func(maxPacketSize int, rtt RTTStats, now time.Time) CongestionController {
+			return paddingCounter{newCongestionController(maxPacketSize, rtt, now), &padding}
+		},
+	})
+	c, sc := dialTestMux(t, cli, srv)
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	readFull(t, sc.stream, []byte("hello"))
+
+	sent := c.PaddingBytesSent()
+	if sent < 1000 {
+		t.Fatalf("sent %d bytes of padding, want a packet's worth at least", sent)
+	}
+	// The packets not eliciting an ack are padded too, but aren't
+	// told to the congestion controller.
+	if n := padding.Load(); n == 0 || n > sent {
+		t.Fatalf("congestion controller was told about %d bytes of padding, want some of %d", n, sent)
+	}
+}
@@ -0,0 +1,145 @@
+package quic
+
+import "time"
+
+// Constants of the path MTU discovery, see RFC 8899.
+const (
+	// pmtuMaxProbes is how many probes of a size must be lost for the size
+	// to be taken as too large for the path. This goes for the current
+	// size too, when confirming a black hole.
+	pmtuMaxProbes = 3
+
+	// The search stops once the largest size known to work is within
+	// pmtuSearchGranularity of the smallest size known not to.
+	pmtuSearchGranularity = 16
+
+	// pmtuRaiseInterval is how long after the search stopped short of the
+	// max packet size a larger size is searched for again, in case the
+	// path changed.
+	pmtuRaiseInterval = 10 * time.Minute
+)
+
+// pmtuDiscoverer finds the largest packet size the path delivers, up to the
+// negotiated max packet size. It probes the path with padded PING packets,
+// searching the sizes between the largest known to work and the smallest known
+// not to. Losing a probe isn't a sign of congestion, so probes don't go through
+// the congestion controller.
+//
+// Losing packets of the current size is likely a sign of congestion, but could
+// be a sign of a black hole: the path stopped delivering packets of the size,
+// for example because the connection migrated without noticing, or a router on
+// the path changed. Before taking the path as a black hole, the discoverer
+// confirms it by probing the current size, see RFC 8899, Section 4.3.
+type pmtuDiscoverer struct {
+	size     int // the largest size known to work
+	tooLarge int // the smallest size known not to work, or maxSize+1
+	maxSize  int
+
+	probing    bool      // a probe is in flight
+	probes     int       // probes of the next size, or the current size if confirming, that were lost
+	raiseTime  time.Time // when to search again, zero if searching
+	confirming bool      // packets of the current size were lost, probing it takes precedence over the search
+}
+
+func newPMTUDiscoverer(maxSize int) pmtuDiscoverer {
+	return pmtuDiscoverer{
+		size:     minPacketSize,
+		tooLarge: maxSize + 1,
+		maxSize:  maxSize,
+	}
+}
+
+// next returns the size to probe next: the max packet size first, as it is
+// likely to work, and halfway between the known sizes afterwards.
+func (d *pmtuDiscoverer) next() int {
+	if d.tooLarge > d.maxSize {
+		return d.maxSize
+	}
+	return (d.size + d.tooLarge) / 2
+}
+
+// searched reports whether the search is over, and if so, schedules the next
+// one.
+func (d *pmtuDiscoverer) searched(now time.Time) bool {
+	if d.size < d.maxSize && d.tooLarge-d.size > pmtuSearchGranularity {
+		return false
+	}
+	if d.size < d.maxSize && d.raiseTime.IsZero() {
+		d.raiseTime = now.Add(pmtuRaiseInterval)
+	}
+	return true
+}
+
+// probe returns the size of the probe to send now, or 0 if none is due. The
+// caller must send the probe.
+func (d *pmtuDiscoverer) probe(now time.Time) int {
+	if d.probing {
+		return 0
+	}
+	if d.confirming {
+		d.probing = true
+		return d.size
+	}
+	if !d.raiseTime.IsZero() && !now.Before(d.raiseTime) {
+		d.tooLarge = d.maxSize + 1
+		d.raiseTime = time.Time{}
+	}
+	if d.searched(now) {
+		return 0
+	}
+	d.probing = true
+	return d.next()
+}
+
+// probeAcked is called when a probe of size bytes was acked.
+func (d *pmtuDiscoverer) probeAcked(size int, now time.Time) {
+	d.probing = false
+	d.probes = 0
+	if size >= d.size {
+		d.confirming = false
+	}
+	d.size = max(d.size, size)
+	d.tooLarge = max(d.tooLarge, d.size+1)
+	d.searched(now)
+}
+
+// probeLost is called when a probe of size bytes was declared lost.
+func (d *pmtuDiscoverer) probeLost(size int, now time.Time) {
+	d.probing = false
+	if d.confirming {
+		if size != d.size {
+			return // a probe of the search, or sent before a fallback
+		}
+		d.probes++
+		if d.probes >= pmtuMaxProbes {
+			// A black hole: fall back to minPacketSize and search
+			// again.
+			d.tooLarge = d.size
+			d.size = minPacketSize
+			d.probes = 0
+			d.raiseTime = time.Time{}
+			d.confirming = false
+		}
+		return
+	}
+	if size <= d.size || size >= d.tooLarge {
+		return // the search moved on
+	}
+	d.probes++
+	if d.probes >= pmtuMaxProbes {
+		d.probes = 0
+		d.tooLarge = size
+		d.searched(now)
+	}
+}
+
+// lost is called when a packet other than a probe, of size bytes, was declared
+// lost. Unless the packet is of minPacketSize, which the path must deliver,
+// the current size is to be confirmed with probes.
+func (d *pmtuDiscoverer) lost(size int) {
+	if size <= minPacketSize || size > d.size || d.confirming {
+		return // unaffected, sent before a fallback, or already confirming
+	}
+	d.confirming = true
+	d.probes = 0
+}
@@ -0,0 +1,129 @@
+package quic
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// discover runs the search of d on a path that delivers packets of up to mtu
+// bytes, and returns the number of probes sent.
+func discover(d *pmtuDiscoverer, mtu int, now time.Time) int {
+	probes := 0
+	for size := d.probe(now); size > 0; size = d.probe(now) {
+		probes++
+		if size <= mtu {
+			d.probeAcked(size, now)
+		} else {
+			d.probeLost(size, now)
+		}
+	}
+	return probes
+}
+
+func TestPMTUDiscovery(t *testing.T) {
+	const maxSize = 1452
+
+	for _, mtu := range []int{1280, 1300, 1400, 1451, 1452, 9000} {
+		t.Run(fmt.Sprint(mtu), func(t *testing.T) {
+			d := newPMTUDiscoverer(maxSize)
+			probes := discover(&d, mtu, time.Now())
+
+			want := min(mtu, maxSize)
+			if d.size > want || d.size <= want-pmtuSearchGranularity {
+				t.Errorf("size = %d, want about %d", d.size, want)
+			}
+			if probes > 8*pmtuMaxProbes {
+				t.Errorf("sent %d probes", probes)
+			}
+		})
+	}
+}
+
+func TestPMTURaise(t *testing.T) {
+	const maxSize = 1452
+
+	now := time.Date(2000, 1, 1, 1, 1, 1, 0, time.UTC)
+	d := newPMTUDiscoverer(maxSize)
+	discover(&d, 1400, now)
+
+	// The path got better.
+	if probes := discover(&d, maxSize, now.Add(pmtuRaiseInterval-time.Second)); probes != 0 {
+		t.Fatalf("sent %d probes before the raise interval, want 0", probes)
+	}
+	discover(&d, maxSize, now.Add(pmtuRaiseInterval))
+	if d.size != maxSize {
+		t.Fatalf("size = %d after the raise interval, want %d", d.size, maxSize)
+	}
+}
+
+func TestPMTUBlackHole(t *testing.T) {
+	const maxSize = 1452
+
+	now := time.Date(2000, 1, 1, 1, 1, 1, 0, time.UTC)
+	d := newPMTUDiscoverer(maxSize)
+	discover(&d, maxSize, now)
+
+	// Losses, however many, only have the current size confirmed
+	// with a probe. Losses of small packets don't count.
+	d.lost(minPacketSize)
+	if size := d.probe(now); size != 0 {
+		t.Fatalf("probed %d bytes after losing a small packet", size)
+	}
+	for i := 0; i < 10; i++ {
+		d.lost(maxSize)
+	}
+	size := d.probe(now)
+	if size != maxSize {
+		t.Fatalf("probed %d bytes after losses, want %d", size, maxSize)
+	}
+
+	// The probe is lost to congestion, but the next one makes it.
+	d.probeLost(size, now)
+	d.probeAcked(d.probe(now), now)
+	if d.size != maxSize {
+		t.Fatalf("size = %d after congestion, want %d", d.size, maxSize)
+	}
+	if size := d.probe(now); size != 0 {
+		t.Fatalf("probed %d bytes after confirming the size", size)
+	}
+
+	// The path now only delivers packets of up to 1300 bytes.
+	d.lost(maxSize)
+	for i := 0; i < pmtuMaxProbes; i++ {
+		d.probeLost(d.probe(now), now)
+	}
+	if d.size != minPacketSize {
+		t.Fatalf("size = %d after black hole, want %d", d.size, minPacketSize)
+	}
+	d.lost(maxSize) // sent before the fallback
+	discover(&d, 1300, now)
+	if d.size > 1300 || d.size <= 1300-pmtuSearchGranularity {
+		t.Fatalf("size = %d, want about %d", d.size, 1300)
+	}
+}
+
+// TestPMTUBlackHoleDuringSearch checks that confirming the current size takes
+// precedence over the search, and that the search goes on afterwards.
+func TestPMTUBlackHoleDuringSearch(t *testing.T) {
+	const maxSize = 1452
+
+	now := time.Date(2000, 1, 1, 1, 1, 1, 0, time.UTC)
+	d := newPMTUDiscoverer(maxSize)
+	discover(&d, 1300, now)
+	current := d.size
+
+	// Searching again, packets of the current size are lost while a probe
+	// of the search is in flight.
+	now = now.Add(pmtuRaiseInterval)
+	search := d.probe(now)
+	d.lost(current)
+	d.probeLost(search, now) // doesn't count while confirming
+	if size := d.probe(now); size != current {
+		t.Fatalf("probed %d bytes, want %d", size, current)
+	}
+	d.probeAcked(current, now)
+	if size := d.probe(now); size != search {
+		t.Fatalf("probed %d bytes after confirming the size, want %d", size, search)
+	}
+}
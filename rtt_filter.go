@@ -13,6 +13,8 @@ const minRTTWnd = time.Minute
 
 // rttFilter is an implementation of RFC 6298 with some modifications.
 type rttFilter struct {
+	maxAckDelay time.Duration // peer's
+
 	minRTT      time.Duration
 	minRTTRenew time.Time
 	smoothedRTT time.Duration
@@ -20,7 +22,9 @@ type rttFilter struct {
 	latestRTT   time.Duration
 }
 
-func newRTTFilter() *rttFilter { return &rttFilter{} }
+func newRTTFilter(maxAckDelay time.Duration) *rttFilter {
+	return &rttFilter{maxAckDelay: maxAckDelay}
+}
 
 func (rf *rttFilter) Update(rtt, delay time.Duration, now time.Time) {
 	const α, β = 0.125, 0.25 // gain
@@ -42,6 +46,15 @@ func (rf *rttFilter) Update(rtt, delay time.Duration, now time.Time) {
 	rf.latestRTT = rtt
 }
 
+func (rf *rttFilter) MinRTT() time.Duration { return rf.minRTT }
+
+func (rf *rttFilter) SmoothedRTT() time.Duration {
+	if rf.smoothedRTT == 0 {
+		return initialRTT
+	}
+	return rf.smoothedRTT
+}
+
 func (rf *rttFilter) LossDurationThreshold() time.Duration {
 	rtt := max(rf.smoothedRTT, rf.latestRTT)
 	if rtt == 0 {
@@ -55,7 +68,7 @@ func (rf *rttFilter) PTO() time.Duration {
 	if smoothedRTT == 0 {
 		smoothedRTT, mdev = initialRTT, initialRTT/2
 	}
-	return smoothedRTT + max(4*mdev, timerGranularity) + maxAckDelay
+	return smoothedRTT + max(4*mdev, timerGranularity) + rf.maxAckDelay
 }
 
 func lerp(x, y, a float64) float64 {
@@ -114,7 +114,7 @@ var rttFilterTests = [][]struct {
 func TestRTTFilter(t *testing.T) {
 	for i, test := range rttFilterTests {
 		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
-			rttFilter := newRTTFilter()
+			rttFilter := newRTTFilter(40 * time.Millisecond)
 
 			for j, c := range test {
 				rttFilter.Update(c.rtt, c.delay, c.now)
@@ -0,0 +1,398 @@
+package quic
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/nanokatze/quic-at-home/internal/wire"
+)
+
+// ErrWriteClosed is returned by Write on a stream closed with CloseWrite.
+var ErrWriteClosed = errors.New("write on a stream closed for writing")
+
+// A Stream is a reliable byte stream. Streams of a Conn are independent of each
+// other: each has its own flow control window, and data lost on one stream does
+// not hold up delivery of data on others.
+type Stream struct {
+	conn *Conn
+	id   int64
+
+	rcvready chan struct{} // you've got data!
+	sndready chan struct{}
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+
+	// Following fields are protected by conn.mu.
+
+	reassembler    *streamReassembler
+	maxOffAcked    int64 // max stream offset that the peer acked
+	maxOffInFlight int64
+	maxRcvdOff     int64 // max stream offset the peer sent data up to
+	finOff         int64 // peer's final stream size, or -1 if not yet known
+
+	fragments     []streamFragment
+	off           int64
+	maxOff        int64 // peer's max stream offset
+	bytesInFlight int   // == ∑_pn ∑ᵢ len(inFlightPackets[pn].streamFragments[i].data) + ∑ᵢ len(fragments[i].data), for fragments of this stream
+	writeClosed   bool
+	finAcked      bool
+}
+
+type streamFragment struct {
+	data []byte
+	id   int64
+	off  int64
+	fin  bool
+}
+
+func (f streamFragment) Split(i int) (streamFragment, streamFragment) {
+	g := streamFragment{
+		data: f.data[i:],
+		id:   f.id,
+		off:  f.off + int64(i),
+		fin:  f.fin,
+	}
+	f.data = f.data[:i]
+	f.fin = false
+	return f, g
+}
+
+func newStream(c *Conn, id int64) *Stream {
+	return &Stream{
+		conn: c,
+		id:   id,
+
+		rcvready: make(chan struct{}, 1),
+		sndready: make(chan struct{}, 1),
+
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+
+		reassembler: newStreamReassembler(c.mux.config.StreamReceiveWindow),
+		finOff:      -1,
+
+		maxOff: c.peerInitialStreamWindow,
+	}
+}
+
+// ID returns the stream ID. The stream that Conn's Read and Write operate on
+// has ID 0.
+func (s *Stream) ID() int64 { return s.id }
+
+// Read returns io.EOF once the peer closed the stream for writing and all of the
+// stream contents were read. If the connection is closed, Read will read
+// remaining stream contents before reporting an error.
+func (s *Stream) Read(b []byte) (int, error) {
+	c := s.conn
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		if s.readDeadline.expired() {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		n, _ := s.reassembler.Read(b)
+		if n == 0 {
+			if s.finOff >= 0 && s.reassembler.ReadOffset() == s.finOff {
+				c.maybeRemoveStream(s)
+				return 0, io.EOF
+			}
+
+			c.mu.Unlock()
+			select {
+			case <-s.rcvready:
+				c.mu.Lock()
+				continue
+			case <-s.readDeadline.done():
+				c.mu.Lock()
+				return 0, os.ErrDeadlineExceeded
+			case <-c.closed:
+				c.mu.Lock()
+				return 0, c.closeErr
+			}
+		}
+
+		select {
+		case c.wakeup <- struct{}{}:
+		default:
+		}
+		c.streamBytesRead += int64(n)
+		return n, nil
+	}
+}
+
+func (s *Stream) Write(b []byte) (int, error) {
+	c := s.conn
+
+	select {
+	default:
+	case <-c.closed:
+		return 0, c.closeErr
+	}
+	if s.writeDeadline.expired() {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	// TODO: evaluate whether to optimize for small writes
+
+	// Avoid retaining b.
+	b = slices_Clone(b)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if s.writeClosed {
+		return 0, ErrWriteClosed
+	}
+	if c.draining {
+		return 0, io.ErrClosedPipe
+	}
+
+	n := 0
+	for n < len(b) {
+		if c.draining {
+			return n, io.ErrClosedPipe
+		}
+
+		nn := min(int(min(int64(len(b)-n), s.maxOff-s.off)), c.mux.config.MaxStreamBytesInFlight-s.bytesInFlight)
+		if nn == 0 {
+			c.mu.Unlock()
+			select {
+			case <-s.sndready:
+				c.mu.Lock()
+				continue
+			case <-s.writeDeadline.done():
+				c.mu.Lock()
+				return n, os.ErrDeadlineExceeded
+			case <-c.closed:
+				c.mu.Lock()
+				return n, c.closeErr
+			}
+		}
+
+		if wire.MaxVarint-s.off < int64(nn) {
+			panic("stream offset wraparound")
+		}
+		s.fragments = append(s.fragments, streamFragment{
+			data: b[n : n+nn],
+			id:   s.id,
+			off:  s.off,
+		})
+		s.off += int64(nn)
+		s.bytesInFlight += nn
+
+		select {
+		case c.wakeup <- struct{}{}:
+		default:
+		}
+
+		c.streamBytesWritten += int64(nn)
+
+		n += nn
+	}
+	return n, nil
+}
+
+// SetDeadline sets the read and write deadlines of the stream, see
+// net.Conn.SetDeadline. The default stream shares deadlines with its Conn.
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for pending and future Read calls.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for pending and future Write calls. Even if
+// Write times out, it may have written some of the data.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// CloseWrite closes the stream for writing. The peer's Read will return io.EOF
+// once it read everything written before CloseWrite.
+func (s *Stream) CloseWrite() error {
+	c := s.conn
+
+	select {
+	default:
+	case <-c.closed:
+		return c.closeErr
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if s.writeClosed {
+		return nil
+	}
+	s.writeClosed = true
+
+	// Piggyback on the last fragment, if it is yet to be sent.
+	if i := len(s.fragments) - 1; i >= 0 && s.fragments[i].off+int64(len(s.fragments[i].data)) == s.off {
+		s.fragments[i].fin = true
+	} else {
+		s.fragments = append(s.fragments, streamFragment{
+			id:  s.id,
+			off: s.off,
+			fin: true,
+		})
+	}
+
+	select {
+	case c.wakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// OpenStream opens a new stream. The peer learns about the stream once it
+// receives the first frame referencing it, which happens as soon as the stream
+// advertises its receive window.
+//
+// If as many of the streams we opened are open as the peer allows, see
+// Config.MaxIncomingStreams, OpenStream blocks until the peer is done with one
+// of them: both peers closed the stream for writing, and each read and got
+// acknowledged everything the other wrote.
+func (c *Conn) OpenStream() (*Stream, error) {
+	select {
+	default:
+	case <-c.closed:
+		return nil, c.closeErr
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.streamCount >= c.peerMaxStreams {
+		c.mu.Unlock()
+		select {
+		case <-c.openready:
+			c.mu.Lock()
+		case <-c.closed:
+			c.mu.Lock()
+			return nil, c.closeErr
+		}
+	}
+
+	id := c.nextStreamID
+	if id > wire.MaxVarint-2 {
+		panic("stream ID wraparound")
+	}
+	c.nextStreamID += 2
+	c.streamCount++
+
+	s := newStream(c, id)
+	c.streams[id] = s
+
+	// Let another blocked OpenStream proceed, if there's room for it too.
+	if c.streamCount < c.peerMaxStreams {
+		select {
+		case c.openready <- struct{}{}:
+		default:
+		}
+	}
+
+	select {
+	case c.wakeup <- struct{}{}:
+	default:
+	}
+	return s, nil
+}
+
+// AcceptStream waits for and returns the next stream opened by the peer.
+func (c *Conn) AcceptStream() (*Stream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.incomingStreams) == 0 {
+		c.mu.Unlock()
+		select {
+		case <-c.acceptready:
+			c.mu.Lock()
+		case <-c.closed:
+			c.mu.Lock()
+			return nil, c.closeErr
+		}
+	}
+
+	s := c.incomingStreams[0]
+	c.incomingStreams[0] = nil // allow GC
+	c.incomingStreams = c.incomingStreams[1:]
+	return s, nil
+}
+
+// streamByID returns the stream with given ID. If the stream is initiated by
+// the peer and wasn't seen before, streamByID opens it, along with all streams
+// initiated by the peer that have lower IDs. streamByID returns a nil Stream if
+// the stream was already closed.
+func (c *Conn) streamByID(id int64) (*Stream, error) {
+	if s, ok := c.streams[id]; ok {
+		return s, nil
+	}
+
+	if id&1 == c.nextStreamID&1 {
+		if id < c.nextStreamID {
+			return nil, nil // closed
+		}
+		return nil, transportErrorf(ProtocolViolation, "reference to a stream that was not opened")
+	}
+	if id < c.nextPeerStreamID {
+		return nil, nil // closed
+	}
+
+	for c.nextPeerStreamID <= id {
+		if c.peerStreamCount >= c.maxPeerStreams {
+			return nil, transportErrorf(StreamLimitError, "too many streams")
+		}
+		s := newStream(c, c.nextPeerStreamID)
+		c.streams[s.id] = s
+		c.incomingStreams = append(c.incomingStreams, s)
+		c.peerStreamCount++
+		c.nextPeerStreamID += 2
+	}
+
+	select {
+	case c.acceptready <- struct{}{}:
+	default:
+	}
+
+	return c.streams[id], nil
+}
+
+// maybeRemoveStream forgets s if both directions of s are done with: the peer
+// acked everything up to and including our FIN, and we read everything up to
+// the peer's FIN. If the peer opened s, the peer may open another stream in
+// its place.
+func (c *Conn) maybeRemoveStream(s *Stream) {
+	if !s.finAcked || s.bytesInFlight > 0 {
+		return
+	}
+	if s.finOff < 0 || s.reassembler.ReadOffset() < s.finOff {
+		return
+	}
+	if _, ok := c.streams[s.id]; !ok {
+		return
+	}
+
+	delete(c.streams, s.id)
+	// The default stream isn't counted, whatever the parity of its ID.
+	if s.id != 0 && s.id&1 != c.nextStreamID&1 {
+		c.maxPeerStreams++
+
+		select {
+		case c.wakeup <- struct{}{}:
+		default:
+		}
+	}
+}
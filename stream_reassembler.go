@@ -47,6 +47,11 @@ func (a *streamReassembler) WriteAt(b []byte, off int64) (int, error) {
 	return n, nil
 }
 
+// ReadOffset returns the offset of the next byte to be read.
+func (a *streamReassembler) ReadOffset() int64 {
+	return a.off
+}
+
 func (a *streamReassembler) MaxOffset() int64 {
 	return a.off + int64(len(a.buf))
 }
@@ -0,0 +1,303 @@
+package quic
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeAll writes data to each of the streams, concurrently, and fails t if
+// any of the writes fail.
+func writeAll(t *testing.T, data []byte, streams ...*Stream) {
+	t.Helper()
+
+	var wg sync.WaitGroup
+	for _, s := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Write(data); err != nil {
+				t.Errorf("stream %d: write: %v", s.ID(), err)
+			}
+		}()
+	}
+	t.Cleanup(wg.Wait)
+}
+
+// readFull reads len(want) bytes from s, and fails t unless they are want.
+func readFull(t *testing.T, s *Stream, want []byte) {
+	t.Helper()
+
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatalf("stream %d: read: %v", s.ID(), err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("stream %d: read data differs from written", s.ID())
+	}
+}
+
+func TestStreams(t *testing.T) {
+	srv, _ := newTestMux(t, Config{Listen: true})
+	cli, _ := newTestMux(t, Config{})
+	c, sc := dialTestMux(t, cli, srv)
+
+	// Streams opened by the dialing side have even IDs, and streams opened
+	// by the accepting side odd ones.
+	for i, want := range []int64{2, 4, 6} {
+		s, err := c.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.ID() != want {
+			t.Fatalf("stream ID = %d, want %d", s.ID(), want)
+		}
+		writeAll(t, bytes.Repeat([]byte{byte(i)}, 10000), s)
+	}
+	s, err := sc.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID() != 1 {
+		t.Fatalf("stream ID = %d, want %d", s.ID(), 1)
+	}
+	writeAll(t, []byte("hello"), s)
+
+	// The peer accepts the streams in the order they were opened.
+	for i, want := range []int64{2, 4, 6} {
+		s, err := sc.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.ID() != want {
+			t.Fatalf("accepted stream ID = %d, want %d", s.ID(), want)
+		}
+		readFull(t, s, bytes.Repeat([]byte{byte(i)}, 10000))
+	}
+	s, err = c.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readFull(t, s, []byte("hello"))
+}
+
+// TestStreamFlowControl checks that each stream has its own receive window,
+// which MAX_STREAM_DATA moves on as the stream is read: a stream the peer
+// doesn't read doesn't hold up the others.
+func TestStreamFlowControl(t *testing.T) {
+	srv, _ := newTestMux(t, Config{Listen: true, StreamReceiveWindow: 4096})
+	cli, _ := newTestMux(t, Config{})
+	c, sc := dialTestMux(t, cli, srv)
+
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	stalled, err := c.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := c.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAll(t, data, stalled, s)
+
+	stalledPeer, err := sc.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sPeer, err := sc.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readFull(t, sPeer, data)
+
+	// The stalled stream was only let send a window's worth of data.
+	sc.mu.Lock()
+	rcvd := stalledPeer.maxRcvdOff
+	sc.mu.Unlock()
+	if rcvd > 4096 {
+		t.Fatalf("stalled stream received %d bytes, beyond the window of %d", rcvd, 4096)
+	}
+
+	readFull(t, stalledPeer, data)
+}
+
+// TestStreamRetransmission checks that stream data, and the MAX_STREAM_DATA
+// and ACK frames moving it along, are delivered despite packet loss.
+func TestStreamRetransmission(t *testing.T) {
+	srv, srvLoss := newTestMux(t, Config{Listen: true, StreamReceiveWindow: 16384})
+	cli, cliLoss := newTestMux(t, Config{})
+	c, sc := dialTestMux(t, cli, srv)
+	cliLoss.every.Store(10)
+	srvLoss.every.Store(7)
+
+	data := bytes.Repeat([]byte("0123456789"), 5000)
+	var streams []*Stream
+	for i := 0; i < 2; i++ {
+		s, err := c.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, s)
+	}
+	writeAll(t, data, streams...)
+
+	for range streams {
+		s, err := sc.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		readFull(t, s, data)
+	}
+
+	c.mu.Lock()
+	lost := c.bytesNacked + c.bytesTimedOut
+	c.mu.Unlock()
+	if lost == 0 {
+		t.Fatalf("no packets were declared lost")
+	}
+}
+
+// TestStreamLimit checks that OpenStream blocks while the peer allows no more
+// streams, until the peer is done with one of them.
+func TestStreamLimit(t *testing.T) {
+	srv, _ := newTestMux(t, Config{Listen: true, MaxIncomingStreams: 2})
+	cli, _ := newTestMux(t, Config{})
+	c, sc := dialTestMux(t, cli, srv)
+
+	var streams []*Stream
+	for i := 0; i < 2; i++ {
+		s, err := c.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, s)
+	}
+
+	opened := make(chan *Stream)
+	go func() {
+		s, err := c.OpenStream()
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- s
+	}()
+	select {
+	case <-opened:
+		t.Fatalf("opened a stream beyond the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Be done with the first stream on both sides.
+	if _, err := streams[0].Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	streams[0].CloseWrite()
+	s, err := sc.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(s); err != nil {
+		t.Fatal(err)
+	}
+	s.CloseWrite()
+
+	select {
+	case s := <-opened:
+		if s.ID() != 6 {
+			t.Fatalf("stream ID = %d, want %d", s.ID(), 6)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("OpenStream still blocked after the peer was done with a stream")
+	}
+}
+
+// TestStreamCloseWrite checks that closing a stream for writing only closes
+// one direction of it: the peer reads io.EOF after the data, and can keep
+// writing.
+func TestStreamCloseWrite(t *testing.T) {
+	srv, _ := newTestMux(t, Config{Listen: true})
+	cli, _ := newTestMux(t, Config{})
+	c, sc := dialTestMux(t, cli, srv)
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("more")); err != ErrWriteClosed {
+		t.Fatalf("write after CloseWrite: err = %v, want %v", err, ErrWriteClosed)
+	}
+	if b, err := io.ReadAll(sc); err != nil || string(b) != "hello" {
+		t.Fatalf("read %q, %v, want %q, %v", b, err, "hello", error(nil))
+	}
+	if _, err := sc.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after EOF: err = %v, want %v", err, io.EOF)
+	}
+
+	if _, err := sc.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(c); err != nil || string(b) != "bye" {
+		t.Fatalf("read %q, %v, want %q, %v", b, err, "bye", error(nil))
+	}
+}
+
+// TestStreamLimitDefaultStream checks that the default stream doesn't count
+// against the limit of the streams the peer opened, even once it is done with.
+func TestStreamLimitDefaultStream(t *testing.T) {
+	srv, _ := newTestMux(t, Config{Listen: true, MaxIncomingStreams: 2})
+	cli, _ := newTestMux(t, Config{})
+	c, sc := dialTestMux(t, cli, srv)
+
+	for i := 0; i < 2; i++ {
+		s, err := c.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sc.AcceptStream(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Be done with the default stream on both sides.
+	c.CloseWrite()
+	sc.CloseWrite()
+	if _, err := io.ReadAll(sc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(c); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		sc.mu.Lock()
+		_, ok := sc.streams[0]
+		sc.mu.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("default stream not forgotten")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.maxPeerStreams != 2 {
+		t.Fatalf("peer may open %d streams, want %d", sc.maxPeerStreams, 2)
+	}
+	var terr *TransportError
+	if _, err := sc.streamByID(6); !errors.As(err, &terr) || terr.Code != StreamLimitError {
+		t.Fatalf("err = %v, want a stream limit error", err)
+	}
+}
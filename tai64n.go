@@ -0,0 +1,40 @@
+package quic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// tai64n is a TAI64N timestamp, see https://cr.yp.to/libtai/tai64.html.
+type tai64n [12]byte
+
+const tai64nBase = 0x400000000000000a
+
+// whitenerMask hides the lower bits of the timestamp, so that it doesn't leak
+// precise timing information, like WireGuard does.
+const whitenerMask = 0x1000000 - 1
+
+func tai64nFromTime(t time.Time) tai64n {
+	var ts tai64n
+	binary.BigEndian.PutUint64(ts[:8], uint64(tai64nBase+t.Unix()))
+	binary.BigEndian.PutUint32(ts[8:], uint32(t.Nanosecond()&^whitenerMask))
+	return ts
+}
+
+// After reports whether ts is after ts2.
+func (ts tai64n) After(ts2 tai64n) bool {
+	return bytes.Compare(ts[:], ts2[:]) > 0
+}
+
+// next returns the smallest timestamp after ts.
+func (ts tai64n) next() tai64n {
+	sec := binary.BigEndian.Uint64(ts[:8])
+	nsec := binary.BigEndian.Uint32(ts[8:]) + 1
+	if nsec == uint32(time.Second) {
+		sec, nsec = sec+1, 0
+	}
+	binary.BigEndian.PutUint64(ts[:8], sec)
+	binary.BigEndian.PutUint32(ts[8:], nsec)
+	return ts
+}
@@ -0,0 +1,40 @@
+package quic
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestTAI64N(t *testing.T) {
+	t0 := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		a, b  time.Time
+		after bool
+	}{
+		{t0.Add(time.Second), t0, true},
+		{t0, t0.Add(time.Second), false},
+		{t0, t0, false},
+		{t0.Add(100 * time.Millisecond), t0, true},
+		// Too close to tell apart, because of whitening.
+		{t0.Add(time.Millisecond), t0, false},
+	}
+	for i, test := range tests {
+		if after := tai64nFromTime(test.a).After(tai64nFromTime(test.b)); after != test.after {
+			t.Errorf("#%d: After = %v, want %v", i, after, test.after)
+		}
+	}
+
+	ts := tai64nFromTime(t0)
+	if next := ts.next(); !next.After(ts) || !tai64nFromTime(t0.Add(100*time.Millisecond)).After(next) {
+		t.Errorf("%x.next() = %x, want a slightly later timestamp", ts, next)
+	}
+
+	// Nanoseconds carry into seconds.
+	binary.BigEndian.PutUint32(ts[8:], uint32(time.Second-1))
+	want := tai64nFromTime(t0.Add(time.Second))
+	if next := ts.next(); next != want {
+		t.Errorf("%x.next() = %x, want %x", ts, next, want)
+	}
+}
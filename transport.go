@@ -1,52 +1,412 @@
 package quic
 
 import (
+	"crypto/mlkem"
+	cryptorand "crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
 	"time"
 
+	"github.com/nanokatze/quic-at-home/internal/sec"
+	"github.com/nanokatze/quic-at-home/internal/udp"
+	"github.com/nanokatze/quic-at-home/internal/wire"
 	"golang.org/x/crypto/curve25519"
 )
 
 const timerGranularity = 5 * time.Millisecond
 
-// !!!noisePrologue, maxPacketSize and maxAckDelay of peers must equal for them to establish connection!!!
-
 // noisePrologue is the prologue string for use during Noise handshake (see
-// Prologue section of Noise).
+// Prologue section of Noise). noisePrologue of peers must equal for them to
+// establish connection.
 var noisePrologue = []byte("My Noise Prologue")
 
-// maxPacketSize puts an upper bound on size of packets received and sent over
-// the underlying quic (UDP) and is the required size of an initial packet.
-const maxPacketSize = 1280
+// minPacketSize is the smallest max packet size a peer may use, and the
+// required size of an initial packet.
+const minPacketSize = 1280
+
+// defaultMaxPacketSize is the max packet size, unless configured otherwise: the
+// largest that fits in a 1500-byte Ethernet frame with IPv6 and UDP headers.
+const defaultMaxPacketSize = 1452
+
+// defaultMaxIncomingStreams is how many streams the peer can have open at once,
+// unless configured otherwise.
+const defaultMaxIncomingStreams = 100
+
+// defaultMaxAckDelay is the delay before sending an ACK in response to a
+// packet, unless configured otherwise.
+const defaultMaxAckDelay = 40 * time.Millisecond
+
+// maxProtocolsLen bounds the encoded length of Config.Protocols, so that they
+// fit in the initial packet along with the handshake payload.
+const maxProtocolsLen = 255
+
+// presharedKeySize is the size of the pre-shared keys, see Config.PresharedKey.
+const presharedKeySize = 32
+
+// maxMaxAckDelay bounds the max ack delay a peer may ask for.
+const maxMaxAckDelay = 1 << 14 * time.Millisecond
+
+// CipherSuite identifies the DH, cipher and hash functions used by the Noise
+// handshake and to protect the packets.
+type CipherSuite uint8
 
-// Delay before sending an ACK in response to a packet.
-const maxAckDelay = 40 * time.Millisecond
+const (
+	// CipherSuiteChaChaPolyBLAKE2b uses the ChaChaPoly cipher and the
+	// BLAKE2b hash.
+	CipherSuiteChaChaPolyBLAKE2b CipherSuite = iota
+
+	// CipherSuiteAESGCMSHA256 uses the AESGCM cipher and the SHA256 hash.
+	// It is much faster than CipherSuiteChaChaPolyBLAKE2b on CPUs with AES
+	// instructions.
+	CipherSuiteAESGCMSHA256
+)
+
+func (suite CipherSuite) String() string {
+	if s := suite.sec(); s != nil {
+		return s.Name()
+	}
+	return fmt.Sprintf("cipher suite %d", uint8(suite))
+}
+
+// sec returns the implementation of suite, or nil if suite is unknown.
+func (suite CipherSuite) sec() *sec.CipherSuite {
+	switch suite {
+	case CipherSuiteChaChaPolyBLAKE2b:
+		return sec.CipherSuite25519ChaChaPolyBLAKE2b
+	case CipherSuiteAESGCMSHA256:
+		return sec.CipherSuite25519AESGCMSHA256
+	}
+	return nil
+}
+
+// Sizes of the static keys. A hybrid key is an X25519 key followed by an
+// ML-KEM-768 key, see GenerateHybridPrivateKey.
+const (
+	privateKeySize       = curve25519.ScalarSize
+	publicKeySize        = curve25519.PointSize
+	hybridPrivateKeySize = privateKeySize + mlkem.SeedSize
+	hybridPublicKeySize  = publicKeySize + mlkem.EncapsulationKeySize768
+)
 
 type PublicKey []byte
 
 type PrivateKey []byte
 
+// GeneratePrivateKey generates an X25519 private key.
+func GeneratePrivateKey() (PrivateKey, error) {
+	privKey := make(PrivateKey, privateKeySize)
+	if _, err := io.ReadFull(cryptorand.Reader, privKey); err != nil {
+		return nil, err
+	}
+	return privKey, nil
+}
+
+// GenerateHybridPrivateKey generates a hybrid private key: an X25519 private
+// key followed by the seed of an ML-KEM-768 decapsulation key. Clients dialing
+// the hybrid public key also encapsulate a secret to the ML-KEM key, which keeps
+// the connections confidential even if X25519 is broken, e.g. by a quantum
+// computer. A server with a hybrid key accepts clients that only know the
+// X25519 part of its public key as well.
+func GenerateHybridPrivateKey() (PrivateKey, error) {
+	privKey, err := GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	kemKey, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+	return append(privKey, kemKey.Bytes()...), nil
+}
+
+// Public returns the public key of privKey. The public key of a hybrid private
+// key is 1216 bytes long: the X25519 public key followed by the ML-KEM-768
+// encapsulation key. Public returns nil if privKey is of neither size.
 func (privKey PrivateKey) Public() PublicKey {
-	publicKey, _ := curve25519.X25519(privKey, curve25519.Basepoint)
+	if len(privKey) != privateKeySize && len(privKey) != hybridPrivateKeySize {
+		return nil
+	}
+	publicKey, _ := curve25519.X25519(privKey[:privateKeySize], curve25519.Basepoint)
+	if len(privKey) == hybridPrivateKeySize {
+		kemKey, _ := mlkem.NewDecapsulationKey768(privKey[privateKeySize:])
+		publicKey = append(publicKey, kemKey.EncapsulationKey().Bytes()...)
+	}
 	return publicKey
 }
 
+// isHybrid reports whether privKey has an ML-KEM part.
+func (privKey PrivateKey) isHybrid() bool {
+	return len(privKey) == hybridPrivateKeySize
+}
+
 // Config is used to configure a Mux. A config must not be modified once while
 // in use. A Config may be in use by multiple Muxes simultaneously.
 type Config struct {
 	// StreamReceiveWindow specifies size of the receive window to use for
 	// receiving the reliable stream data. StreamReceiveWindow must be
-	// non-zero.
+	// positive.
 	StreamReceiveWindow int
 
 	// MaxStreamBytesInFlight bounds how many bytes carrying reliable stream
-	// data can be in flight.
+	// data can be in flight, per stream.
 	MaxStreamBytesInFlight int
 
+	// MaxIncomingStreams bounds how many streams the peer can have open at
+	// once. The default stream is not counted. It is advertised to the
+	// peer, whose OpenStream blocks until one of its streams is done with,
+	// see Conn.OpenStream. Zero means 100.
+	MaxIncomingStreams int
+
+	// Linger, if non-zero, makes Conn's Close graceful: Close waits up to
+	// Linger for the peer to acknowledge all stream data before closing the
+	// connection. See Conn.CloseContext.
+	Linger time.Duration
+
+	// MaxIdleTimeout, if non-zero, closes a connection with ErrIdleTimeout
+	// when nothing was received from the peer for that long. Peers exchange
+	// their MaxIdleTimeout during the handshake and both use the smaller
+	// non-zero one.
+	MaxIdleTimeout time.Duration
+
+	// KeepAlivePeriod, if non-zero, makes a connection send a PING when
+	// nothing was received from the peer for that long, keeping the
+	// connection and NAT bindings on the path alive. Like MaxIdleTimeout,
+	// it is negotiated during the handshake. KeepAlivePeriod should be
+	// well below MaxIdleTimeout.
+	KeepAlivePeriod time.Duration
+
+	// Authorize, if not nil, is called for every incoming connection once
+	// the client has authenticated, before the handshake is responded to
+	// and any per-connection state is allocated. If Authorize returns an
+	// error, the connection is rejected. Authorize is called from the Mux's
+	// receiving goroutine and must not block.
+	Authorize func(peer PublicKey, raddr netip.AddrPort) error
+
+	// VerifyPeer is called when dialing without knowing the peer's static
+	// public key, see Mux.DialContextAddrPort, with the key the peer
+	// presented during the handshake. If VerifyPeer returns an error, the
+	// handshake is aborted and DialContextAddrPort fails with the error.
+	// VerifyPeer can implement trust on first use by remembering the keys
+	// of the peers it has seen.
+	VerifyPeer func(peer PublicKey) error
+
+	// ResponsePayload, if not nil, is called for every incoming connection
+	// that passed Authorize, with the payload the client dialed with. It
+	// returns the payload to send back to the client in the handshake
+	// response, at most MaxHandshakePayloadLen bytes long. If
+	// ResponsePayload returns an error, the connection is rejected like by
+	// Authorize. Like Authorize, ResponsePayload must not block.
+	//
+	// The client's payload may be a replay of an earlier connection attempt,
+	// thus acting upon it must be idempotent.
+	ResponsePayload func(peer PublicKey, raddr netip.AddrPort, payload []byte) ([]byte, error)
+
+	// NotifyRejected makes the Mux respond to clients rejected by Authorize
+	// or ResponsePayload with an authenticated rejection carrying the text
+	// of the returned error. The client's DialContextAddrPort reports it as
+	// a *RejectedError. Otherwise, rejected clients get no response.
+	NotifyRejected bool
+
 	// PrivateKey contains the static private key. The public counterpart is
 	// presented to the remote party during the handshake. The remote party
-	// may discriminate and deny peers based on their public keys.
+	// may discriminate and deny peers based on their public keys. Only the
+	// X25519 part of a hybrid key is presented, see
+	// GenerateHybridPrivateKey.
 	PrivateKey PrivateKey
 
+	// MaxPacketSize is the size of the largest packet to send and to accept
+	// from the peer. The connection sends 1280-byte packets at first, and
+	// discovers the largest size the path delivers, up to the smaller of
+	// the peers' MaxPacketSize. Zero means 1452, which fits in an Ethernet
+	// frame. The smallest MaxPacketSize allowed is 1280, and the largest
+	// 65535.
+	MaxPacketSize int
+
+	// NewCongestionController, if not nil, returns the congestion
+	// controller of a new connection, and of a connection that migrated to
+	// a new path. rtt are the RTT estimates of the path. See
+	// NewRenoCongestionController, NewCUBICCongestionController and
+	// NewBBRCongestionController. By
+	// default, connections stay in slow start, and reset the congestion
+	// window on congestion.
+	NewCongestionController func(maxPacketSize int, rtt RTTStats, now time.Time) CongestionController
+
+	// PaddingPolicy, if not nil, pads the packets sent, so that their
+	// sizes tell observers less about the data they carry. See
+	// PadToMaxPacketSize, PadToBuckets and PadToRecentMax. Padding counts
+	// against the congestion window like any other data, but the
+	// congestion controller is told how much of each packet it is, see
+	// CongestionController.Sent, and Conn.PaddingBytesSent tells how much
+	// the padding costs.
+	PaddingPolicy PaddingPolicy
+
+	// MaxAckDelay bounds the delay before acknowledging a packet. It is
+	// advertised to the peer in whole milliseconds, and the peer takes it
+	// into account when detecting loss. MaxAckDelay must be at least a
+	// millisecond. Zero means 40ms.
+	MaxAckDelay time.Duration
+
+	// MsgReceiveWindow is the initial receive window of the message
+	// ReadWriter, see Conn.SetMsgReceiveWindow. It is advertised to the
+	// peer, whose WriteMsg rejects messages that wouldn't fit.
+	MsgReceiveWindow int
+
+	// Protocols lists the application protocols supported, in the order of
+	// preference. The dialing side offers its Protocols to the peer, and
+	// the listening side selects the first of its Protocols that the peer
+	// offered, see Conn.Protocol. The offer and the selection are
+	// authenticated by the handshake. If Protocols is not empty, the
+	// listening side rejects peers that offer none of Protocols, and the
+	// dialing side fails to connect to peers that select none of Protocols,
+	// with ErrNoCommonProtocol. The protocols must be non-empty, and at most
+	// 255 bytes long in total, counting a byte of length prefix per
+	// protocol (two bytes for protocols longer than 63 bytes).
+	Protocols []string
+
+	// PresharedKey, if not nil, is a 32-byte secret mixed into the
+	// handshake (Noise IKpsk2), in addition to the static keys. The dialing
+	// side uses it for every connection, which requires knowing the peer's
+	// static public key. The listening side with a PresharedKey or
+	// GetPresharedKey ignores clients that don't use a pre-shared key, and
+	// the other way around. If the pre-shared keys of the peers differ,
+	// the client fails to complete the handshake, and the server's response
+	// reveals nothing about the server.
+	PresharedKey []byte
+
+	// GetPresharedKey, if not nil, returns the pre-shared key to use with
+	// the client whose static public key is peer, overriding PresharedKey
+	// on the listening side. If GetPresharedKey returns an error, the
+	// client is ignored. Like Authorize, GetPresharedKey must not block.
+	GetPresharedKey func(peer PublicKey) ([]byte, error)
+
+	// CipherSuite is the cipher suite to use. Both peers must use the same
+	// CipherSuite: the listening side refuses to connect clients using a
+	// different one, and the client's DialContextAddrPort fails with
+	// ErrCipherSuiteMismatch.
+	CipherSuite CipherSuite
+
 	// Listen for incoming connections.
 	Listen bool
 }
+
+func (config *Config) validate() error {
+	if n := len(config.PrivateKey); n != privateKeySize && n != hybridPrivateKeySize {
+		return errors.New("bad PrivateKey")
+	}
+	if config.CipherSuite.sec() == nil {
+		return errors.New("unknown CipherSuite")
+	}
+	if config.PresharedKey != nil && len(config.PresharedKey) != presharedKeySize {
+		return errors.New("PresharedKey must be 32 bytes long")
+	}
+	if config.StreamReceiveWindow <= 0 {
+		return errors.New("StreamReceiveWindow must be positive")
+	}
+	if config.MaxIncomingStreams < 0 {
+		return errors.New("negative MaxIncomingStreams")
+	}
+	if config.MaxPacketSize != 0 && config.MaxPacketSize < minPacketSize {
+		return errors.New("MaxPacketSize too small")
+	}
+	if config.MaxPacketSize > udp.MaxSegmentSize {
+		return errors.New("MaxPacketSize too large")
+	}
+	if policy, ok := config.PaddingPolicy.(padToRecentMax); ok && policy.n < 1 {
+		return errors.New("PadToRecentMax needs at least one packet")
+	}
+	if config.MaxAckDelay > maxMaxAckDelay {
+		return errors.New("MaxAckDelay too large")
+	}
+	if config.MaxAckDelay != 0 && config.MaxAckDelay < time.Millisecond {
+		return errors.New("MaxAckDelay too small")
+	}
+	n := 0
+	for _, protocol := range config.Protocols {
+		if protocol == "" {
+			return errors.New("empty protocol")
+		}
+		n += wire.VarintLen(int64(len(protocol))) + len(protocol)
+	}
+	if n > maxProtocolsLen {
+		return errors.New("Protocols too long")
+	}
+	return nil
+}
+
+// transportParameters returns the transport parameters to send to the peer.
+func (config *Config) transportParameters() wire.TransportParameters {
+	return wire.TransportParameters{
+		MaxIdleTimeout:      config.MaxIdleTimeout,
+		KeepAlivePeriod:     config.KeepAlivePeriod,
+		MaxPacketSize:       config.maxPacketSize(),
+		MaxAckDelay:         config.maxAckDelay(),
+		InitialStreamWindow: int64(config.StreamReceiveWindow),
+		MsgWindow:           int64(config.MsgReceiveWindow),
+		MaxStreams:          int64(config.maxIncomingStreams()),
+		Protocols:           config.Protocols,
+	}
+}
+
+// requiresPresharedKey reports whether the listening side only accepts clients
+// using a pre-shared key.
+func (config *Config) requiresPresharedKey() bool {
+	return config.PresharedKey != nil || config.GetPresharedKey != nil
+}
+
+// presharedKey returns the pre-shared key to use with peer on the listening
+// side.
+func (config *Config) presharedKey(peer PublicKey) ([]byte, error) {
+	if config.GetPresharedKey == nil {
+		return config.PresharedKey, nil
+	}
+	psk, err := config.GetPresharedKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	if len(psk) != presharedKeySize {
+		return nil, errors.New("pre-shared key must be 32 bytes long")
+	}
+	return psk, nil
+}
+
+func (config *Config) maxPacketSize() int {
+	if config.MaxPacketSize == 0 {
+		return defaultMaxPacketSize
+	}
+	return config.MaxPacketSize
+}
+
+func (config *Config) maxIncomingStreams() int {
+	if config.MaxIncomingStreams == 0 {
+		return defaultMaxIncomingStreams
+	}
+	return config.MaxIncomingStreams
+}
+
+func (config *Config) newCongestionController(maxPacketSize int, rtt RTTStats, now time.Time) CongestionController {
+	if config.NewCongestionController == nil {
+		return newCongestionController(maxPacketSize, rtt, now)
+	}
+	return config.NewCongestionController(maxPacketSize, rtt, now)
+}
+
+func (config *Config) maxAckDelay() time.Duration {
+	if config.MaxAckDelay == 0 {
+		return defaultMaxAckDelay
+	}
+	return config.MaxAckDelay
+}
+
+// validateTransportParameters checks the transport parameters received from
+// the peer.
+func validateTransportParameters(params wire.TransportParameters) error {
+	if params.MaxPacketSize != 0 && params.MaxPacketSize < minPacketSize {
+		return errors.New("peer's max packet size too small")
+	}
+	if params.MaxAckDelay > maxMaxAckDelay {
+		return errors.New("peer's max ack delay too large")
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package quic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nanokatze/quic-at-home/internal/udp"
+)
+
+func TestConfigValidate(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config func(*Config)
+		ok     bool
+	}{
+		{"defaults", func(*Config) {}, true},
+
+		{"zero StreamReceiveWindow", func(c *Config) { c.StreamReceiveWindow = 0 }, false},
+		{"negative StreamReceiveWindow", func(c *Config) { c.StreamReceiveWindow = -1 }, false},
+
+		{"min MaxPacketSize", func(c *Config) { c.MaxPacketSize = minPacketSize }, true},
+		{"MaxPacketSize too small", func(c *Config) { c.MaxPacketSize = minPacketSize - 1 }, false},
+		{"max MaxPacketSize", func(c *Config) { c.MaxPacketSize = udp.MaxSegmentSize }, true},
+		{"MaxPacketSize too large", func(c *Config) { c.MaxPacketSize = udp.MaxSegmentSize + 1 }, false},
+
+		{"min MaxAckDelay", func(c *Config) { c.MaxAckDelay = time.Millisecond }, true},
+		{"max MaxAckDelay", func(c *Config) { c.MaxAckDelay = maxMaxAckDelay }, true},
+		{"MaxAckDelay too large", func(c *Config) { c.MaxAckDelay = maxMaxAckDelay + time.Millisecond }, false},
+		{"MaxAckDelay too small", func(c *Config) { c.MaxAckDelay = 500 * time.Microsecond }, false}, // would be advertised as 0, meaning 40ms
+	} {
+		config := Config{
+			PrivateKey:          make(PrivateKey, privateKeySize),
+			StreamReceiveWindow: 1 << 20,
+		}
+		test.config(&config)
+		if err := config.validate(); (err == nil) != test.ok {
+			t.Errorf("%s: err = %v, want ok = %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestPrivateKeyPublicInvalid(t *testing.T) {
+	for _, privKey := range []PrivateKey{nil, make(PrivateKey, 16), make(PrivateKey, privateKeySize+1)} {
+		if pubKey := privKey.Public(); pubKey != nil {
+			t.Errorf("%d-byte private key: Public() = %x, want nil", len(privKey), pubKey)
+		}
+	}
+}
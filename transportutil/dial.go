@@ -7,7 +7,7 @@ import (
 	"net/netip"
 	"time"
 
-	"github.com/nanokatze/quic-at-home"
+	quic "github.com/nanokatze/quic-at-home"
 )
 
 const attempts = 5
@@ -15,8 +15,9 @@ const attempts = 5
 // DialContext connects to the given address.
 //
 // If the address resolves to multiple IP addresses, DialContext will try to
-// connect to all IP addresses concurrently.
-func DialContext(ctx context.Context, mux *transport.Mux, address string, remoteStaticPublicKey transport.PublicKey) (*transport.Conn, error) {
+// connect to all IP addresses concurrently. payload is sent in the handshake,
+// see quic.Mux.DialContextAddrPort.
+func DialContext(ctx context.Context, mux *quic.Mux, address string, remoteStaticPublicKey quic.PublicKey, payload []byte) (*quic.Conn, error) {
 	host, service, err := net.SplitHostPort(address)
 	if err != nil {
 		return nil, err
@@ -35,7 +36,7 @@ func DialContext(ctx context.Context, mux *transport.Mux, address string, remote
 	defer cancel()
 
 	type dialResult struct {
-		*transport.Conn
+		*quic.Conn
 		error
 	}
 	results := make(chan dialResult)
@@ -51,9 +52,9 @@ func DialContext(ctx context.Context, mux *transport.Mux, address string, remote
 				dialCtx, cancel := context.WithTimeout(ctx, timeout)
 				defer cancel()
 
-				c, err := mux.DialContextAddrPort(dialCtx, remoteStaticPublicKey, addr)
-				if err == transport.ErrAgain {
-					c, err = mux.DialContextAddrPort(dialCtx, remoteStaticPublicKey, addr) // try again, with a new cookie
+				c, err := mux.DialContextAddrPort(dialCtx, remoteStaticPublicKey, addr, payload)
+				if err == quic.ErrAgain {
+					c, err = mux.DialContextAddrPort(dialCtx, remoteStaticPublicKey, addr, payload) // try again, with a new cookie
 				}
 
 				select {
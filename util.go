@@ -3,6 +3,7 @@ package quic
 import (
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 const forever = 1000000 * time.Second
@@ -23,6 +24,29 @@ func min[T ~int | ~int64](x, y T) T {
 	return y
 }
 
+// minNonZero returns the smaller of x and y, ignoring whichever of them is zero.
+func minNonZero[T ~int | ~int64](x, y T) T {
+	if x == 0 {
+		return y
+	}
+	if y == 0 {
+		return x
+	}
+	return min(x, y)
+}
+
+// truncateUTF8 returns the longest prefix of s that is at most n bytes long and
+// doesn't split a UTF-8 encoded character.
+func truncateUTF8[S ~string | ~[]byte](s S, n int) S {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
 // slices_Clone returns a copy of the slice.
 // The elements are copied using assignment, so this is a shallow clone.
 //
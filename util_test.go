@@ -0,0 +1,24 @@
+package quic
+
+import "testing"
+
+func TestTruncateUTF8(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 5, "hello"},
+		{"hello", 3, "hel"},
+		{"héllo", 2, "h"}, // é is 2 bytes long
+		{"héllo", 3, "hé"},
+		{"日本", 5, "日"}, // each is 3 bytes long
+		{"日本", 2, ""},
+		{"\xff\xff", 1, "\xff"}, // not UTF-8
+	} {
+		if got := truncateUTF8(test.s, test.n); got != test.want {
+			t.Errorf("truncateUTF8(%q, %d) = %q, want %q", test.s, test.n, got, test.want)
+		}
+	}
+}